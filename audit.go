@@ -0,0 +1,116 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	AuditCreate        = "create"
+	AuditRevoke        = "revoke"
+	AuditAddDimensions = "add_dimensions"
+	AuditReplace       = "replace_values"
+	AuditRecompute     = "recompute"
+	AuditMove          = "move"
+
+	ActivityLimit = 100
+)
+
+// recordAudit adds an audit event within the transaction making the change,
+// so the event is stored if and only if the change is.
+func recordAudit(tx *gorm.DB, user *UserInfo, project_id int64,
+	action, object_type string, object_id int64, detail string) error {
+	event := &AuditEvent{
+		ProjectId:  project_id,
+		UserId:     user.Id,
+		Action:     action,
+		ObjectType: object_type,
+		ObjectId:   object_id,
+		Detail:     detail,
+		RemoteAddr: user.RemoteAddr,
+		UserAgent:  user.UserAgent}
+	if user.Key != nil {
+		event.APIKeyId = user.Key.Id
+	}
+	return Err.Wrap(tx.Create(event).Error)
+}
+
+func (d *Data) ProjectActivity(project_id int64, limit int) (
+	events []AuditEvent, err error) {
+	return events, Err.Wrap(d.db.Where("project_id = ?", project_id).Order(
+		"created_at desc").Limit(limit).Find(&events).Error)
+}
+
+type AuditFilter struct {
+	ProjectId int64
+	UserId    string
+	Action    string
+	Since     time.Time
+	Limit     int
+}
+
+func (d *Data) AuditEvents(filter AuditFilter) (
+	events []AuditEvent, err error) {
+	query := d.db
+	if filter.ProjectId != 0 {
+		query = query.Where("project_id = ?", filter.ProjectId)
+	}
+	if filter.UserId != "" {
+		query = query.Where("user_id = ?", filter.UserId)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	return events, Err.Wrap(query.Order("created_at desc").Limit(
+		filter.Limit).Find(&events).Error)
+}
+
+// auditCommand implements "cwbench audit", which prints the audit events
+// matching the given flags.
+func auditCommand(data *Data, out io.Writer, args []string) error {
+	var filter AuditFilter
+	var since string
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.Int64Var(&filter.ProjectId, "project", 0, "only show this project")
+	flags.StringVar(&filter.UserId, "user", "", "only show this user id")
+	flags.StringVar(&filter.Action, "action", "", "only show this action")
+	flags.StringVar(&since, "since", "",
+		"only show events since this date (YYYY-MM-DD)")
+	flags.IntVar(&filter.Limit, "limit", ActivityLimit,
+		"maximum number of events to show")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if since != "" {
+		filter.Since, err = time.Parse("2006-01-02", since)
+		if err != nil {
+			return err
+		}
+	}
+
+	events, err := data.AuditEvents(filter)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPROJECT\tUSER\tKEY\tACTION\tOBJECT\tDETAIL\tADDR")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s %d\t%s\t%s\n",
+			event.CreatedAt.Format(time.RFC3339), event.ProjectId, event.UserId,
+			event.APIKeyId, event.Action, event.ObjectType, event.ObjectId,
+			event.Detail, event.RemoteAddr)
+	}
+	return w.Flush()
+}
@@ -6,12 +6,19 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
 	"golang.org/x/net/context"
 	"gopkg.in/go-webhelp/whoauth2.v1"
 	"gopkg.in/webhelp.v1/whcompat"
 	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whlog"
 	"gopkg.in/webhelp.v1/whredir"
 	"gopkg.in/webhelp.v1/whroute"
 )
@@ -44,19 +51,64 @@ type UserInfo struct {
 	FamilyName    string `json:"family_name"`
 	Link          string `json:"link"`
 	Picture       string `json:"picture"`
+
+	// Key is the API key the request was authenticated with, if any.
+	Key *APIKey `json:"-"`
+
+	// RemoteAddr and UserAgent describe the request, for the audit log.
+	RemoteAddr string `json:"-"`
+	UserAgent  string `json:"-"`
+}
+
+// Scoped is true if the user is limited by the scope of an API key.
+func (u *UserInfo) Scoped() bool {
+	return u != nil && u.Key != nil && u.Key.Scoped()
+}
+
+func (u *UserInfo) ReadOnly() bool {
+	return u != nil && u.Key != nil && u.Key.ReadOnly
+}
+
+// ProjectScope returns the projects the user's API key is limited to, if it
+// is.
+func (u *UserInfo) ProjectScope() (ids []int64, limited bool) {
+	if u == nil || u.Key == nil || u.Key.Projects == "" {
+		return nil, false
+	}
+	return u.Key.ProjectIds(), true
+}
+
+func (u *UserInfo) CanAccessProject(project_id int64) bool {
+	ids, limited := u.ProjectScope()
+	if !limited {
+		return true
+	}
+	for _, id := range ids {
+		if id == project_id {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *Endpoints) LoadUser(ctx context.Context, inr *http.Request) (
 	*UserInfo, error) {
-	if inr.FormValue("api_key") != "" {
-		key, err := a.Data.APIKey(inr.FormValue("api_key"))
+	if api_key := requestAPIKey(inr); api_key != "" {
+		key, err := a.Data.APIKey(api_key)
 		if err != nil {
 			return nil, err
 		}
 		if key == nil {
 			return nil, wherr.Unauthorized.New("invalid api key")
 		}
-		return &UserInfo{Id: key.UserId}, nil
+		if key.Expired(time.Now()) {
+			return nil, wherr.Unauthorized.New("expired api key")
+		}
+		err = a.Data.TouchAPIKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &UserInfo{Id: key.UserId, Key: key}, nil
 	}
 
 	t, err := oauth2.Token(ctx)
@@ -90,30 +142,100 @@ func (a *Endpoints) LoadUser(ctx context.Context, inr *http.Request) (
 	return &data, nil
 }
 
+// requestAPIKey returns the API key the request was made with, from either
+// an "Authorization: Bearer" header, an X-API-Key header, or the legacy
+// api_key query parameter, in that order. It never reads the request body, so
+// handlers that stream uploads still can.
+func requestAPIKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") &&
+		strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// wantsJSON is true for requests from API clients, which should get errors
+// as JSON rather than login redirects.
+func wantsJSON(r *http.Request) bool {
+	return requestAPIKey(r) != "" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func jsonError(w http.ResponseWriter, err error, default_code int) {
+	code := errhttp.GetStatusCode(err, default_code)
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cwbench"`)
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": errors.GetMessage(err)})
+}
+
+var apiKeyParam = regexp.MustCompile(`([?&]api_key=)[^&\s"]*`)
+
+// scrubbedLogger logs like whlog.Default, but with api_key query values
+// removed from the logged request URIs.
+func scrubbedLogger(format string, arg ...interface{}) {
+	whlog.Default("%s", apiKeyParam.ReplaceAllString(
+		fmt.Sprintf(format, arg...), "${1}REDACTED"))
+}
+
 type ctxKey int
 
 var (
 	userKey ctxKey = 1
 )
 
-func (a *Endpoints) LoginRequired(h http.Handler) http.Handler {
+// LoginOptional loads the logged in user, if there is one, for LoadUser.
+// Anonymous visitors get a nil *UserInfo, which the Data methods treat as
+// only having read access to public projects.
+func (a *Endpoints) LoginOptional(h http.Handler) http.Handler {
 	return whroute.HandlerFunc(h,
 		func(w http.ResponseWriter, r *http.Request) {
 			ctx := whcompat.Context(r)
 			user, err := a.LoadUser(ctx, r)
 			if err != nil {
+				if wantsJSON(r) {
+					jsonError(w, err, http.StatusUnauthorized)
+					return
+				}
 				wherr.Handle(w, r, err)
 				return
 			}
-			if user == nil {
-				whredir.Redirect(w, r, oauth2.LoginURL(r.RequestURI, false))
-				return
+			if user != nil {
+				user.RemoteAddr = r.RemoteAddr
+				user.UserAgent = r.UserAgent()
 			}
 			ctx = context.WithValue(ctx, userKey, user)
 			h.ServeHTTP(w, whcompat.WithContext(r, ctx))
 		})
 }
 
+// LoginRequired sends anonymous visitors to log in. It must be wrapped by
+// LoginOptional.
+func LoginRequired(h http.Handler) http.Handler {
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, r *http.Request) {
+			if LoadUser(whcompat.Context(r)) != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if wantsJSON(r) {
+				jsonError(w, wherr.Unauthorized.New("login required"),
+					http.StatusUnauthorized)
+				return
+			}
+			whredir.Redirect(w, r, oauth2.LoginURL(r.RequestURI, false))
+		})
+}
+
+// LoadUser returns the logged in user, or nil for anonymous visitors.
 func LoadUser(ctx context.Context) *UserInfo {
-	return ctx.Value(userKey).(*UserInfo)
+	user, _ := ctx.Value(userKey).(*UserInfo)
+	return user
 }
@@ -0,0 +1,133 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// ComparedDimension is a dimension both compared samples have values for,
+// with each sample's difference from its control.
+type ComparedDimension struct {
+	DimensionId int64
+	A, B        float64
+}
+
+type Comparison struct {
+	// Shared is the number of dimensions both samples have values for.
+	Shared   int
+	Pearson  float64
+	Spearman float64
+	Cosine   float64
+
+	// Concordant and Discordant hold the dimensions that move in the same
+	// and in opposite directions in both samples, strongest first.
+	Concordant []ComparedDimension
+	Discordant []ComparedDimension
+
+	// SharedUp, SharedDown and Opposite compare the samples' top-k
+	// signatures.
+	SharedUp   []int64
+	SharedDown []int64
+	Opposite   []int64
+	// Overlap is the Jaccard index of the signatures' dimensions, counting
+	// only dimensions in the same direction as shared.
+	Overlap float64
+}
+
+func (d *Data) Compare(a_id, b_id int64, k int, top_k_type TopKType) (
+	*Comparison, error) {
+	a_values, err := d.samples.get(d.db, a_id)
+	if err != nil {
+		return nil, err
+	}
+	b_values, err := d.samples.get(d.db, b_id)
+	if err != nil {
+		return nil, err
+	}
+	diff := sampleValueKey(top_k_type.column())
+
+	// both samples' values are ordered by dimension id.
+	var dims []ComparedDimension
+	for i, j := 0, 0; i < len(a_values) && j < len(b_values); {
+		a_val, b_val := a_values[i], b_values[j]
+		switch {
+		case a_val.DimensionId < b_val.DimensionId:
+			i++
+		case a_val.DimensionId > b_val.DimensionId:
+			j++
+		default:
+			dims = append(dims, ComparedDimension{
+				DimensionId: a_val.DimensionId,
+				A:           diff(a_val),
+				B:           diff(b_val)})
+			i++
+			j++
+		}
+	}
+
+	rv := &Comparison{Shared: len(dims)}
+	a, b := make([]float64, len(dims)), make([]float64, len(dims))
+	for i, dim := range dims {
+		a[i], b[i] = dim.A, dim.B
+		switch {
+		case dim.A*dim.B > 0:
+			rv.Concordant = append(rv.Concordant, dim)
+		case dim.A*dim.B < 0:
+			rv.Discordant = append(rv.Discordant, dim)
+		}
+	}
+	rv.Pearson = correlate(CorrelationPearson, a, b)
+	rv.Cosine = correlate(CorrelationCosine, a, b)
+	rv.Spearman = correlate(CorrelationSpearman,
+		fractionalRanks(a), fractionalRanks(b))
+	rv.Concordant = strongest(rv.Concordant, k)
+	rv.Discordant = strongest(rv.Discordant, k)
+
+	a_up, a_down, err := d.TopKSignature(a_id, k, top_k_type)
+	if err != nil {
+		return nil, err
+	}
+	b_up, b_down, err := d.TopKSignature(b_id, k, top_k_type)
+	if err != nil {
+		return nil, err
+	}
+	b_up_set, b_down_set := idSet(b_up), idSet(b_down)
+	for _, id := range a_up {
+		if b_up_set[id] {
+			rv.SharedUp = append(rv.SharedUp, id)
+		} else if b_down_set[id] {
+			rv.Opposite = append(rv.Opposite, id)
+		}
+	}
+	for _, id := range a_down {
+		if b_down_set[id] {
+			rv.SharedDown = append(rv.SharedDown, id)
+		} else if b_up_set[id] {
+			rv.Opposite = append(rv.Opposite, id)
+		}
+	}
+	union := len(a_up) + len(a_down) + len(b_up) + len(b_down) -
+		len(rv.SharedUp) - len(rv.SharedDown) - len(rv.Opposite)
+	if union > 0 {
+		rv.Overlap = float64(len(rv.SharedUp)+len(rv.SharedDown)) /
+			float64(union)
+	} else {
+		rv.Overlap = math.NaN()
+	}
+	return rv, nil
+}
+
+// strongest returns the (at most) k dimensions with the largest product of
+// differences.
+func strongest(dims []ComparedDimension, k int) []ComparedDimension {
+	sort.Slice(dims, func(i, j int) bool {
+		return math.Abs(dims[i].A*dims[i].B) > math.Abs(dims[j].A*dims[j].B)
+	})
+	if len(dims) > k {
+		dims = dims[:k]
+	}
+	return dims
+}
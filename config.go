@@ -0,0 +1,114 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	envPrefix  = "CWBENCH_"
+	fileSuffix = "_file"
+)
+
+var (
+	configFile = flag.String("config", "",
+		"a YAML file of flag values. a value for <flag>_file is read from "+
+			"that file instead. environment variables named CWBENCH_<FLAG> "+
+			"and CWBENCH_<FLAG>_FILE take precedence over the file, and "+
+			"command line flags take precedence over both")
+	devMode = flag.Bool("dev", false,
+		"allow insecure settings meant for development, such as the default "+
+			"cookie secret")
+)
+
+// loadConfig fills in the flags that weren't given on the command line from
+// environment variables and the config file. It must be called after
+// flag.Parse.
+func loadConfig() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if !set["config"] {
+		if path, found := os.LookupEnv(envName("config")); found {
+			*configFile = path
+		}
+	}
+	file_values := map[string]interface{}{}
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(data, &file_values)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *configFile, err)
+		}
+		for name := range file_values {
+			if flag.Lookup(strings.TrimSuffix(name, fileSuffix)) == nil {
+				return fmt.Errorf("%s: unknown setting %q", *configFile, name)
+			}
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "config" {
+			return
+		}
+		val, found, lerr := lookupSetting(f.Name, file_values)
+		if lerr != nil {
+			err = lerr
+			return
+		}
+		if found {
+			err = flag.Set(f.Name, val)
+			if err != nil {
+				err = fmt.Errorf("setting %s: %v", f.Name, err)
+			}
+		}
+	})
+	return err
+}
+
+func envName(flag_name string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(
+		".", "_", "-", "_").Replace(flag_name))
+}
+
+func lookupSetting(name string, file_values map[string]interface{}) (
+	val string, found bool, err error) {
+	env := envName(name)
+	if val, found := os.LookupEnv(env); found {
+		return val, true, nil
+	}
+	if path, found := os.LookupEnv(env + strings.ToUpper(fileSuffix)); found {
+		val, err := readSecret(path)
+		return val, true, err
+	}
+	if val, found := file_values[name]; found {
+		return fmt.Sprint(val), true, nil
+	}
+	if path, found := file_values[name+fileSuffix]; found {
+		val, err := readSecret(fmt.Sprint(path))
+		return val, true, err
+	}
+	return "", false, nil
+}
+
+// readSecret reads a setting from a file, such as a mounted secret, without
+// its trailing newline.
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+type CorrelationType string
+
+const (
+	CorrelationPearson  CorrelationType = "pearson"
+	CorrelationSpearman CorrelationType = "spearman"
+	CorrelationCosine   CorrelationType = "cosine"
+)
+
+func (c CorrelationType) Valid() bool {
+	switch c {
+	case CorrelationPearson, CorrelationSpearman, CorrelationCosine:
+		return true
+	}
+	return false
+}
+
+func (t TopKType) column() string {
+	if t == TopKValueDiff {
+		return "value_diff"
+	}
+	return "rank_diff"
+}
+
+// sampleVectors holds one diff vector per sample in a project, indexed by
+// the position of the dimension in dims. Dimensions a sample has no value
+// for (see AddDimensions) are NaN. Once loaded, it is only read from, so
+// it's shared between all search workers.
+type sampleVectors struct {
+	dims    []int64
+	vectors map[int64][]float64
+	ranks   map[int64][]float64
+}
+
+func (d *Data) sampleVectors(proj_id int64, top_k_type TopKType,
+	with_ranks bool) (*sampleVectors, error) {
+	var dims []Dimension
+	err := d.db.Where("project_id = ?", proj_id).Order("id asc").Find(
+		&dims).Error
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	positions := make(map[int64]int, len(dims))
+	rv := &sampleVectors{
+		dims:    make([]int64, 0, len(dims)),
+		vectors: map[int64][]float64{}}
+	for i, dim := range dims {
+		positions[dim.Id] = i
+		rv.dims = append(rv.dims, dim.Id)
+	}
+
+	diff := sampleValueKey(top_k_type.column())
+	err = d.samples.each(d.db, proj_id,
+		func(sample_id int64, values []SampleValue) error {
+			vec := make([]float64, len(rv.dims))
+			for i := range vec {
+				vec[i] = math.NaN()
+			}
+			for _, val := range values {
+				pos, exists := positions[val.DimensionId]
+				if !exists {
+					return ErrBadDims.New("dimension missing")
+				}
+				vec[pos] = diff(val)
+			}
+			rv.vectors[sample_id] = vec
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if with_ranks {
+		rv.ranks = make(map[int64][]float64, len(rv.vectors))
+		for sample_id, vec := range rv.vectors {
+			rv.ranks[sample_id] = fractionalRanks(vec)
+		}
+	}
+	return rv, nil
+}
+
+// fractionalRanks ranks the non-NaN entries of vec, giving ties the average
+// of the ranks they span, as Spearman's correlation expects.
+func fractionalRanks(vec []float64) []float64 {
+	idx := make([]int, 0, len(vec))
+	for i, val := range vec {
+		if !math.IsNaN(val) {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool { return vec[idx[i]] < vec[idx[j]] })
+	ranks := make([]float64, len(vec))
+	for i := range ranks {
+		ranks[i] = math.NaN()
+	}
+	for i := 0; i < len(idx); {
+		j := i + 1
+		for j < len(idx) && vec[idx[j]] == vec[idx[i]] {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for ; i < j; i++ {
+			ranks[idx[i]] = rank
+		}
+	}
+	return ranks
+}
+
+// correlate computes the correlation over the dimensions both a and b have
+// values for. It returns NaN if the correlation is undefined.
+func correlate(corr_type CorrelationType, a, b []float64) float64 {
+	var n, sum_a, sum_b float64
+	for i := range a {
+		if math.IsNaN(a[i]) || math.IsNaN(b[i]) {
+			continue
+		}
+		n += 1
+		sum_a += a[i]
+		sum_b += b[i]
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	var mean_a, mean_b float64
+	if corr_type != CorrelationCosine {
+		mean_a, mean_b = sum_a/n, sum_b/n
+	}
+	var dot, norm_a, norm_b float64
+	for i := range a {
+		if math.IsNaN(a[i]) || math.IsNaN(b[i]) {
+			continue
+		}
+		da, db := a[i]-mean_a, b[i]-mean_b
+		dot += da * db
+		norm_a += da * da
+		norm_b += db * db
+	}
+	if norm_a == 0 || norm_b == 0 {
+		return math.NaN()
+	}
+	return dot / math.Sqrt(norm_a*norm_b)
+}
+
+func (v *sampleVectors) correlate(corr_type CorrelationType,
+	a, b int64) float64 {
+	if corr_type == CorrelationSpearman {
+		return correlate(corr_type, v.ranks[a], v.ranks[b])
+	}
+	return correlate(corr_type, v.vectors[a], v.vectors[b])
+}
+
+func (d *Data) CorrelationSearch(ctx context.Context,
+	proj_id, sample_id int64, corr_type CorrelationType, top_k_type TopKType) (
+	result SearchResults, err error) {
+	vectors, err := d.sampleVectors(proj_id, top_k_type,
+		corr_type == CorrelationSpearman)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := vectors.vectors[sample_id]; !exists {
+		return nil, ErrNotFound.New("sample has no values")
+	}
+	return d.search(ctx, proj_id, func(other_id int64) (float64, error) {
+		if _, exists := vectors.vectors[other_id]; !exists {
+			return math.NaN(), nil
+		}
+		return vectors.correlate(corr_type, sample_id, other_id), nil
+	})
+}
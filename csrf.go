@@ -0,0 +1,82 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+const (
+	csrfNamespace = "csrf"
+	csrfField     = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token of the request's session, creating and
+// storing one if the session doesn't have one yet. It must be called before
+// anything is written to w.
+func csrfToken(ctx context.Context, w http.ResponseWriter) (string, error) {
+	sess, err := whsess.Load(ctx, csrfNamespace)
+	if err != nil {
+		return "", err
+	}
+	if token, ok := sess.Values["token"].(string); ok && token != "" {
+		return token, nil
+	}
+	var buf [32]byte
+	_, err = rand.Read(buf[:])
+	if err != nil {
+		return "", Err.Wrap(err)
+	}
+	token := hex.EncodeToString(buf[:])
+	sess.Values["token"] = token
+	return token, sess.Save(w)
+}
+
+// checkCSRF makes sure state-changing requests authenticated by session
+// cookie carry the session's CSRF token. Requests authenticated with an API
+// key are exempt, as browsers don't send those on their own.
+func checkCSRF(ctx context.Context, req *http.Request, user *UserInfo) error {
+	if csrfExempt(req, user) {
+		return nil
+	}
+	actual := req.Header.Get(csrfHeader)
+	if actual == "" {
+		form, err := parseForm(req)
+		if err != nil {
+			return err
+		}
+		actual = form.Get(csrfField)
+	}
+	return verifyCSRF(ctx, actual)
+}
+
+func csrfExempt(req *http.Request, user *UserInfo) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return user != nil && user.Key != nil
+}
+
+// verifyCSRF compares actual against the session's CSRF token.
+func verifyCSRF(ctx context.Context, actual string) error {
+	sess, err := whsess.Load(ctx, csrfNamespace)
+	if err != nil {
+		return err
+	}
+	expected, _ := sess.Values["token"].(string)
+	if expected == "" || subtle.ConstantTimeCompare(
+		[]byte(expected), []byte(actual)) != 1 {
+		return wherr.Forbidden.New("invalid or missing csrf token")
+	}
+	return nil
+}
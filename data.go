@@ -5,18 +5,24 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"flag"
+	"fmt"
 	"math"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spacemonkeygo/errors"
 	"github.com/spacemonkeygo/errors/errhttp"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -28,22 +34,40 @@ var (
 	searchParallelism = flag.Int("parallelism", runtime.NumCPU()+1,
 		"number of parellel search queries to execute")
 
-	Err         = errors.NewClass("error")
-	ErrNotFound = Err.NewClass("not found", errhttp.SetStatusCode(404))
-	ErrDenied   = Err.NewClass("denied", errhttp.SetStatusCode(405))
-	ErrBadDims  = Err.NewClass("wrong dimensions", errhttp.SetStatusCode(400))
+	Err          = errors.NewClass("error")
+	ErrNotFound  = Err.NewClass("not found", errhttp.SetStatusCode(404))
+	ErrDenied    = Err.NewClass("denied", errhttp.SetStatusCode(405))
+	ErrBadDims   = Err.NewClass("wrong dimensions", errhttp.SetStatusCode(400))
+	ErrCanceled  = Err.NewClass("canceled", errhttp.SetStatusCode(503))
+	ErrBadValues = Err.NewClass("bad values", errhttp.SetStatusCode(400))
 )
 
 type Data struct {
-	db *gorm.DB
+	db      *gorm.DB
+	samples sampleStore
 }
 
 func NewData() (*Data, error) {
+	samples, err := newSampleStore(*sampleStorage)
+	if err != nil {
+		return nil, err
+	}
 	db, err := gorm.Open(*dbType, *dbConn)
 	if err != nil {
 		return nil, Err.Wrap(err)
 	}
-	return &Data{db: db}, nil
+	instrumentDB(db)
+	d := &Data{db: db, samples: samples}
+	err = d.checkSampleStorage()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Data) Ping() error {
+	return Err.Wrap(d.db.DB().Ping())
 }
 
 func (d *Data) DB() *gorm.DB {
@@ -54,14 +78,25 @@ func (d *Data) Close() error {
 	return Err.Wrap(d.db.Close())
 }
 
+const (
+	apiKeyPrefixLen = 8
+	// apiKeyTouchInterval limits how often a key's LastUsedAt is written.
+	apiKeyTouchInterval = time.Minute
+)
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
 func (d *Data) APIKeys(user_id string) (keys []*APIKey, err error) {
 	return keys, Err.Wrap(d.db.Where("user_id = ?", user_id).Order(
-		"key asc").Find(&keys).Error)
+		"created_at desc").Find(&keys).Error)
 }
 
 func (d *Data) APIKey(key string) (*APIKey, error) {
 	var rv APIKey
-	err := d.db.Where("key = ?", key).FirstOrInit(&rv).Error
+	err := d.db.Where("hash = ?", hashAPIKey(key)).FirstOrInit(&rv).Error
 	if err != nil {
 		return nil, Err.Wrap(err)
 	}
@@ -71,7 +106,15 @@ func (d *Data) APIKey(key string) (*APIKey, error) {
 	return &rv, nil
 }
 
-func (d *Data) NewAPIKey(user_id string) (key string, err error) {
+// NewAPIKey returns the only copy of the new key's secret. Only its hash is
+// stored.
+func (d *Data) NewAPIKey(user *UserInfo, name string, expires_at *time.Time,
+	read_only bool, project_ids []int64) (key string, err error) {
+	projects := make([]string, 0, len(project_ids))
+	for _, id := range project_ids {
+		projects = append(projects, strconv.FormatInt(id, 10))
+	}
+
 	var value [16]byte
 	_, err = rand.Read(value[:])
 	if err != nil {
@@ -81,31 +124,88 @@ func (d *Data) NewAPIKey(user_id string) (key string, err error) {
 
 	tx := txWrapper{DB: d.db.Begin()}
 	defer tx.Rollback()
-	err = tx.Create(&APIKey{
-		UserId: user_id,
-		Key:    key}).Error
+	api_key := APIKey{
+		UserId:    user.Id,
+		Name:      name,
+		Hash:      hashAPIKey(key),
+		Prefix:    key[:apiKeyPrefixLen],
+		ExpiresAt: expires_at,
+		ReadOnly:  read_only,
+		Projects:  strings.Join(projects, ",")}
+	err = tx.Create(&api_key).Error
 	if err != nil {
 		return "", Err.Wrap(err)
 	}
+	err = recordAudit(tx.DB, user, 0, AuditCreate, "api_key", api_key.Id, name)
+	if err != nil {
+		return "", err
+	}
 
 	tx.Commit()
 	return key, nil
 }
 
-func (d *Data) Projects(user_id string) (rv []*Project, err error) {
-	return rv, Err.Wrap(d.db.Where(
-		"public OR user_id = ?", user_id).Order("name asc").Find(&rv).Error)
+func (d *Data) RevokeAPIKey(user *UserInfo, key_id int64) error {
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+	res := tx.Where("id = ? AND user_id = ?", key_id, user.Id).Delete(
+		APIKey{})
+	if res.Error != nil {
+		return Err.Wrap(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound.New("no such api key")
+	}
+	err := recordAudit(tx.DB, user, 0, AuditRevoke, "api_key", key_id, "")
+	if err != nil {
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// TouchAPIKey records that the key was just used, at most once every
+// apiKeyTouchInterval.
+func (d *Data) TouchAPIKey(key *APIKey) error {
+	now := time.Now()
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < apiKeyTouchInterval {
+		return nil
+	}
+	key.LastUsedAt = &now
+	return Err.Wrap(d.db.Model(APIKey{}).Where("id = ?", key.Id).Update(
+		"last_used_at", now).Error)
 }
 
-func (d *Data) Project(user_id string, project_id int64) (proj *Project,
+func (d *Data) Projects(user *UserInfo) (rv []*Project, err error) {
+	query := d.db.Where("public")
+	if user != nil {
+		query = d.db.Where("public OR user_id = ?", user.Id)
+	}
+	if ids, limited := user.ProjectScope(); limited {
+		query = query.Where("id IN (?)", append(ids, -1))
+	}
+	return rv, Err.Wrap(query.Order("name asc").Find(&rv).Error)
+}
+
+// Project returns the project if the user can see it. The project is read
+// only unless the user owns it and isn't using a read only API key. A nil
+// user is an anonymous visitor, who can only see public projects.
+func (d *Data) Project(user *UserInfo, project_id int64) (proj *Project,
 	read_only bool, err error) {
+	if !user.CanAccessProject(project_id) {
+		return nil, true, ErrNotFound.New("not found")
+	}
+	query := d.db.Where("public AND id = ?", project_id)
+	if user != nil {
+		query = d.db.Where("(public OR user_id = ?) AND id = ?", user.Id,
+			project_id)
+	}
 	proj = &Project{}
-	err = d.db.Where("(public OR user_id = ?) AND id = ?", user_id,
-		project_id).First(proj).Error
+	err = query.First(proj).Error
 	if err != nil {
 		return nil, true, ErrNotFound.Wrap(err)
 	}
-	return proj, proj.UserId != user_id, nil
+	return proj, user == nil || proj.UserId != user.Id || user.ReadOnly(), nil
 }
 
 func (d *Data) ProjectInfo(project_id int64) (dimensions int,
@@ -119,17 +219,27 @@ func (d *Data) ProjectInfo(project_id int64) (dimensions int,
 	if err != nil {
 		return 0, nil, nil, Err.Wrap(err)
 	}
-	err = d.db.Where("project_id = ?", project_id).Order("name asc").Find(
-		&controls).Error
-	return dimensions, samples, controls, Err.Wrap(err)
+	controls, err = d.Controls(project_id)
+	return dimensions, samples, controls, err
 }
 
-func (d *Data) NewProject(user_id, name string,
+func (d *Data) Controls(project_id int64) (controls []Control, err error) {
+	return controls, Err.Wrap(d.db.Where("project_id = ?", project_id).Order(
+		"name asc").Find(&controls).Error)
+}
+
+func (d *Data) NewProject(user *UserInfo, name string,
 	dimensions func(deliver func(dim string) error) error) (
 	proj_id int64, err error) {
+	if user == nil {
+		return 0, ErrDenied.New("login required")
+	}
+	if user.Scoped() {
+		return 0, ErrDenied.New("api key can't create projects")
+	}
 	tx := txWrapper{DB: d.db.Begin()}
 	defer tx.Rollback()
-	proj := Project{UserId: user_id, Name: name}
+	proj := Project{UserId: user.Id, Name: name}
 	err = tx.Create(&proj).Error
 	if err != nil {
 		return 0, Err.Wrap(err)
@@ -145,10 +255,71 @@ func (d *Data) NewProject(user_id, name string,
 	if err != nil {
 		return 0, err
 	}
+	err = recordAudit(tx.DB, user, proj.Id, AuditCreate, "project", proj.Id,
+		name)
+	if err != nil {
+		return 0, err
+	}
 	tx.Commit()
 	return proj.Id, nil
 }
 
+// AddDimensions appends dimensions to a project. Existing controls and
+// samples are left alone and become partial; only controls uploaded
+// afterwards (and their samples) cover the new dimensions.
+func (d *Data) AddDimensions(user *UserInfo, project_id int64,
+	dimensions func(deliver func(dim string) error) error) (
+	added int, err error) {
+
+	err = d.AssertWriteAccess(user, project_id, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+
+	// locking the project makes concurrent uploads to it wait for each other,
+	// so each sees the dimensions the others added.
+	err = tx.Exec(`SELECT id FROM projects WHERE id = ? FOR UPDATE;`,
+		project_id).Error
+	if err != nil {
+		return 0, Err.Wrap(err)
+	}
+	var existing []Dimension
+	err = tx.Where("project_id = ?", project_id).Find(&existing).Error
+	if err != nil {
+		return 0, Err.Wrap(err)
+	}
+	seen := make(map[string]bool, len(existing))
+	for _, dim := range existing {
+		seen[dim.Name] = true
+	}
+
+	err = dimensions(func(dim string) error {
+		if seen[dim] {
+			return ErrBadDims.New("duplicated dimension %#v", dim)
+		}
+		seen[dim] = true
+		added += 1
+		return Err.Wrap(tx.Create(&Dimension{
+			ProjectId: project_id, Name: dim}).Error)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if added == 0 {
+		return 0, ErrBadDims.New("no dimensions provided")
+	}
+	err = recordAudit(tx.DB, user, project_id, AuditAddDimensions, "project",
+		project_id, fmt.Sprintf("%d dimensions", added))
+	if err != nil {
+		return 0, err
+	}
+	tx.Commit()
+	return added, nil
+}
+
 type DimLookup struct {
 	db     *gorm.DB
 	projId int64
@@ -244,13 +415,13 @@ func (d *Data) DimCount(project_id int64) (rv int, err error) {
 		project_id).Count(&rv).Error)
 }
 
-func (d *Data) AssertWriteAccess(user_id string, project_id int64,
+func (d *Data) AssertWriteAccess(user *UserInfo, project_id int64,
 	control_id *int64) (err error) {
 	var read_only bool
 	if control_id != nil {
-		_, _, read_only, err = d.Control(user_id, project_id, *control_id)
+		_, _, read_only, err = d.Control(user, project_id, *control_id)
 	} else {
-		_, read_only, err = d.Project(user_id, project_id)
+		_, read_only, err = d.Project(user, project_id)
 	}
 	if err != nil {
 		return err
@@ -261,7 +432,7 @@ func (d *Data) AssertWriteAccess(user_id string, project_id int64,
 	return nil
 }
 
-func (d *Data) Sample(user_id string, project_id, sample_id int64) (
+func (d *Data) Sample(user *UserInfo, project_id, sample_id int64) (
 	*Project, *Sample, error) {
 	var sample Sample
 	err := d.db.Where("id = ?", sample_id).First(&sample).Error
@@ -271,17 +442,47 @@ func (d *Data) Sample(user_id string, project_id, sample_id int64) (
 	if project_id != sample.ProjectId {
 		return nil, nil, ErrNotFound.New("not found")
 	}
-	proj, _, err := d.Project(user_id, sample.ProjectId)
+	proj, _, err := d.Project(user, sample.ProjectId)
 	return proj, &sample, err
 }
 
 func (d *Data) SampleValues(sample_id int64) (
 	values []SampleValue, err error) {
-	return values, Err.Wrap(d.db.Where(
-		"sample_id = ?", sample_id).Order("rank_diff desc").Find(&values).Error)
+	values, err = d.samples.get(d.db, sample_id)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(valueSorter{values: values, key: sampleValueKey("rank_diff"),
+		desc: true})
+	return values, nil
+}
+
+// SampleValuesPage returns the page of the sample's values the pager asks
+// for, and sets the pager's Total.
+func (d *Data) SampleValuesPage(sample_id int64, pager *Pager) (
+	values []SampleValue, err error) {
+	return d.samples.page(d.db, sample_id, pager)
+}
+
+func valuesPage(query *gorm.DB, table string, pager *Pager,
+	values interface{}) error {
+	if pager.Filter != "" {
+		query = query.Joins("JOIN dimensions ON dimensions.id = "+
+			table+".dimension_id").Where(
+			`LOWER(dimensions.name) LIKE ? ESCAPE '\'`,
+			likePattern(pager.Filter))
+	}
+	err := query.Count(&pager.Total).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	return Err.Wrap(query.Select(table + ".*").Order(
+		table + "." + pager.OrderBy()).Order(
+		table + ".dimension_id asc").Offset(pager.Offset).Limit(
+		pager.Limit).Find(values).Error)
 }
 
-func (d *Data) Control(user_id string, project_id, control_id int64) (
+func (d *Data) Control(user *UserInfo, project_id, control_id int64) (
 	proj *Project, control *Control, read_only bool, err error) {
 	control = &Control{}
 	err = d.db.Where("id = ?", control_id).First(control).Error
@@ -291,7 +492,7 @@ func (d *Data) Control(user_id string, project_id, control_id int64) (
 	if project_id != control.ProjectId {
 		return nil, nil, true, ErrNotFound.New("not found")
 	}
-	proj, read_only, err = d.Project(user_id, control.ProjectId)
+	proj, read_only, err = d.Project(user, control.ProjectId)
 	return proj, control, read_only, err
 }
 
@@ -306,10 +507,15 @@ func (d *Data) ControlByName(project_id int64, name string) (
 	return control, nil
 }
 
-func Ranked(count int,
+// Ranked ranks exactly count values, after normalizing them with norm if it
+// isn't nil. Controls are ranked over all of the project's dimensions at
+// upload time, samples over their control's dimensions, which may be a subset
+// if dimensions were added later.
+func Ranked(count int, norm Normalizer,
 	values func(func(dim_id int64, value float64) error) error) (
-	ranked func(func(dim_id int64, value float64, rank int) error) error) {
-	return func(deliv func(dim_id int64, value float64, rank int) error) error {
+	ranked func(func(dim_id int64, raw, value float64, rank int) error) error) {
+	return func(
+		deliv func(dim_id int64, raw, value float64, rank int) error) error {
 		seen := make(map[int64]bool, count)
 		tosort := make(rankList, 0, count)
 
@@ -318,7 +524,7 @@ func Ranked(count int,
 				return ErrBadDims.New("duplicated dimension")
 			}
 			seen[dim_id] = true
-			tosort = append(tosort, rankEntry{id: dim_id, val: value})
+			tosort = append(tosort, rankEntry{id: dim_id, raw: value, val: value})
 			return nil
 		})
 		if err != nil {
@@ -331,17 +537,28 @@ func Ranked(count int,
 				"submission dimensions don't match project dimensions")
 		}
 
+		if norm != nil {
+			err = norm(tosort)
+			if err != nil {
+				return err
+			}
+		}
+
 		return tosort.Rank(func(entry rankEntry, value float64, rank int) error {
-			return deliv(entry.id, value, rank)
+			return deliv(entry.id, entry.raw, value, rank)
 		})
 	}
 }
 
-func (d *Data) NewControl(user_id string, project_id int64, name string,
-	values func(deliver func(dim_id int64, value float64) error) error) (
+// NewControl stores a control built from one or more replicates per
+// dimension, combined with aggregate. Each dimension keeps the standard
+// deviation of its replicates.
+func (d *Data) NewControl(user *UserInfo, project_id int64, name string,
+	aggregate Aggregate,
+	values func(deliver func(dim_id int64, replicates []float64) error) error) (
 	control_id int64, err error) {
 
-	err = d.AssertWriteAccess(user_id, project_id, nil)
+	err = d.AssertWriteAccess(user, project_id, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -349,25 +566,30 @@ func (d *Data) NewControl(user_id string, project_id int64, name string,
 	tx := txWrapper{DB: d.db.Begin()}
 	defer tx.Rollback()
 
-	control := Control{ProjectId: project_id, Name: name}
+	count, err := d.DimCount(project_id)
+	if err != nil {
+		return 0, err
+	}
+
+	control := Control{ProjectId: project_id, Name: name,
+		DimensionCount: count, Aggregate: string(aggregate)}
 	err = tx.Create(&control).Error
 	if err != nil {
 		return 0, Err.Wrap(err)
 	}
 
-	count, err := d.DimCount(project_id)
+	err = storeControlValues(tx.DB, &control, aggregate, values)
 	if err != nil {
 		return 0, err
 	}
 
-	err = Ranked(count, values)(
-		func(dim_id int64, value float64, rank int) error {
-			return Err.Wrap(tx.Create(&ControlValue{
-				ControlId:   control.Id,
-				DimensionId: dim_id,
-				Value:       value,
-				Rank:        rank}).Error)
-		})
+	err = tx.Model(&control).Update("replicates", control.Replicates).Error
+	if err != nil {
+		return 0, Err.Wrap(err)
+	}
+
+	err = recordAudit(tx.DB, user, project_id, AuditCreate, "control",
+		control.Id, name)
 	if err != nil {
 		return 0, err
 	}
@@ -376,8 +598,41 @@ func (d *Data) NewControl(user_id string, project_id int64, name string,
 	return control.Id, nil
 }
 
+// storeControlValues ranks and stores control.DimensionCount values for the
+// control, combining replicates with aggregate, and sets control.Replicates.
+func storeControlValues(tx *gorm.DB, control *Control, aggregate Aggregate,
+	values func(deliver func(dim_id int64, replicates []float64) error) error) (
+	err error) {
+	control.Replicates = 0
+	std_devs := make(map[int64]float64, control.DimensionCount)
+	aggregated := func(deliver func(dim_id int64, value float64) error) error {
+		return values(func(dim_id int64, replicates []float64) error {
+			if control.Replicates == 0 {
+				control.Replicates = len(replicates)
+			} else if len(replicates) != control.Replicates {
+				return ErrBadValues.New(
+					"every dimension needs the same number of replicates")
+			}
+			value, std_dev := aggregate.Of(replicates)
+			std_devs[dim_id] = std_dev
+			return deliver(dim_id, value)
+		})
+	}
+
+	return Ranked(control.DimensionCount, nil, aggregated)(
+		func(dim_id int64, raw, value float64, rank int) error {
+			return Err.Wrap(tx.Create(&ControlValue{
+				ControlId:   control.Id,
+				DimensionId: dim_id,
+				Value:       value,
+				StdDev:      std_devs[dim_id],
+				Rank:        rank}).Error)
+		})
+}
+
 type rankEntry struct {
 	id  int64
+	raw float64
 	val float64
 }
 type rankList []rankEntry
@@ -415,12 +670,22 @@ func (d *Data) ControlValues(control_id int64) (
 		"control_id = ?", control_id).Order("rank desc").Find(&values).Error)
 }
 
-func (d *Data) NewSample(user_id string, project_id, control_id int64,
-	name string,
+func (d *Data) ControlValuesPage(control_id int64, pager *Pager) (
+	values []ControlValue, err error) {
+	query := d.db.Model(ControlValue{}).Where("control_id = ?", control_id)
+	return values, valuesPage(query, "control_values", pager, &values)
+}
+
+// NewSample ranks and stores a sample's values, normalized as opts says. The
+// control is normalized the same way, and the sample's rank and value
+// differences are computed against the result, with value differences
+// measured as diff_type says.
+func (d *Data) NewSample(user *UserInfo, project_id, control_id int64,
+	name string, opts NormalizeOptions, diff_type DiffType,
 	values func(deliver func(dim_id int64, value float64) error) error) (
 	sample_id int64, err error) {
 
-	err = d.AssertWriteAccess(user_id, project_id, &control_id)
+	err = d.AssertWriteAccess(user, project_id, &control_id)
 	if err != nil {
 		return 0, err
 	}
@@ -430,24 +695,103 @@ func (d *Data) NewSample(user_id string, project_id, control_id int64,
 		return 0, err
 	}
 
-	control_lookup := make(map[int64]*ControlValue, len(control_values))
-	for i := range control_values {
-		control_lookup[control_values[i].DimensionId] = &control_values[i]
+	if diff_type == DiffZScore {
+		if opts.Method != NormNone && opts.Method != NormQuantile {
+			return 0, ErrBadValues.New("z-scored differences can only be " +
+				"used with values on the control's scale")
+		}
+		var control Control
+		err = d.db.Where("id = ?", control_id).First(&control).Error
+		if err != nil {
+			return 0, Err.Wrap(err)
+		}
+		err = diff_type.checkControl(&control)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	norm, control_lookup, err := d.sampleReference(project_id, control_values,
+		opts)
+	if err != nil {
+		return 0, err
 	}
 
 	tx := txWrapper{DB: d.db.Begin()}
 	defer tx.Rollback()
 
-	sample := Sample{ProjectId: project_id, Name: name, ControlId: control_id}
+	sample := Sample{ProjectId: project_id, Name: name, ControlId: control_id,
+		DimensionCount: len(control_values), Normalization: string(opts.Method),
+		NormControls: opts.controlList(), DiffType: string(diff_type)}
 	err = tx.Create(&sample).Error
 	if err != nil {
 		return 0, Err.Wrap(err)
 	}
 
-	seen := make(map[int64]bool, len(control_values))
+	err = d.storeSampleValues(tx.DB, &sample, norm, control_lookup, values)
+	if err != nil {
+		return 0, err
+	}
 
-	err = Ranked(len(control_values), values)(
-		func(dim_id int64, value float64, rank int) error {
+	err = markSearchesStale(tx.DB, project_id)
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordAudit(tx.DB, user, project_id, AuditCreate, "sample",
+		sample.Id, name)
+	if err != nil {
+		return 0, err
+	}
+
+	tx.Commit()
+	return sample.Id, nil
+}
+
+// SampleReferenceValues returns the control values the sample was compared
+// against, normalized and ranked the way the sample was, by dimension id.
+func (d *Data) SampleReferenceValues(sample *Sample) (
+	map[int64]*ControlValue, error) {
+	control_values, err := d.ControlValues(sample.ControlId)
+	if err != nil {
+		return nil, err
+	}
+	_, control_lookup, err := d.sampleReference(sample.ProjectId,
+		control_values, sample.NormalizeOptions())
+	return control_lookup, err
+}
+
+// sampleReference builds the normalizer for a sample's values and the
+// control values and ranks they are compared against.
+func (d *Data) sampleReference(project_id int64, control_values []ControlValue,
+	opts NormalizeOptions) (norm Normalizer,
+	control_lookup map[int64]*ControlValue, err error) {
+	refs, err := d.referenceControls(project_id, opts.Controls)
+	if err != nil {
+		return nil, nil, err
+	}
+	norm, err = normalizer(opts, control_values, refs)
+	if err != nil {
+		return nil, nil, err
+	}
+	control_lookup, err = referenceValues(control_values, norm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return norm, control_lookup, nil
+}
+
+// storeSampleValues ranks and stores the sample's values against
+// control_lookup, which must cover exactly sample.DimensionCount dimensions.
+func (d *Data) storeSampleValues(tx *gorm.DB, sample *Sample, norm Normalizer,
+	control_lookup map[int64]*ControlValue,
+	values func(deliver func(dim_id int64, value float64) error) error) error {
+	diff_type := DiffType(sample.DiffType)
+	seen := make(map[int64]bool, sample.DimensionCount)
+	stored := make([]SampleValue, 0, sample.DimensionCount)
+
+	err := Ranked(sample.DimensionCount, norm, values)(
+		func(dim_id int64, raw, value float64, rank int) error {
 			if seen[dim_id] {
 				return ErrBadDims.New("duplicated dimension")
 			}
@@ -455,7 +799,7 @@ func (d *Data) NewSample(user_id string, project_id, control_id int64,
 
 			control, exists := control_lookup[dim_id]
 			if !exists {
-				return ErrBadDims.New("dimension mismatch")
+				return ErrBadDims.New("dimension not covered by control")
 			}
 
 			rank_diff := rank - control.Rank
@@ -464,12 +808,12 @@ func (d *Data) NewSample(user_id string, project_id, control_id int64,
 				abs_rank_diff *= -1
 			}
 
-			value_diff := value - control.Value
+			value_diff := diff_type.valueDiff(value, control)
 			abs_value_diff := value_diff
 			if abs_value_diff < 0 {
 				abs_value_diff *= -1
 			}
-			return Err.Wrap(tx.Create(&SampleValue{
+			stored = append(stored, SampleValue{
 				SampleId:    sample.Id,
 				DimensionId: dim_id,
 
@@ -477,21 +821,47 @@ func (d *Data) NewSample(user_id string, project_id, control_id int64,
 				RankDiff:    rank_diff,
 				AbsRankDiff: abs_rank_diff,
 
+				RawValue:     raw,
 				Value:        value,
 				ValueDiff:    value_diff,
 				AbsValueDiff: abs_value_diff,
-			}).Error)
+			})
+			return nil
 		})
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	if len(seen) != len(control_values) {
-		return 0, ErrBadDims.New("bad dimension count")
+	if len(seen) != sample.DimensionCount {
+		return ErrBadDims.New("bad dimension count")
 	}
+	return d.samples.put(tx, sample.Id, stored)
+}
 
-	tx.Commit()
-	return sample.Id, nil
+// referenceControls loads the values of each of the project's controls in
+// control_ids.
+func (d *Data) referenceControls(project_id int64, control_ids []int64) (
+	refs [][]ControlValue, err error) {
+	if len(control_ids) == 0 {
+		return nil, nil
+	}
+	var count int
+	err = d.db.Model(Control{}).Where("project_id = ? AND id IN (?)",
+		project_id, control_ids).Count(&count).Error
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	if count != len(control_ids) {
+		return nil, ErrNotFound.New("reference control")
+	}
+	for _, control_id := range control_ids {
+		values, err := d.ControlValues(control_id)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, values)
+	}
+	return refs, nil
 }
 
 type TopKType string
@@ -503,12 +873,9 @@ const (
 
 func (d *Data) TopKSignature(sample_id int64, k int,
 	top_k_type TopKType) (up, down []int64, err error) {
-	var values []SampleValue
-
-	err = d.db.Where("sample_id = ?", sample_id).Order(
-		string(top_k_type)).Limit(k).Find(&values).Error
+	values, err := d.samples.topK(d.db, sample_id, k, top_k_type)
 	if err != nil {
-		return nil, nil, Err.Wrap(err)
+		return nil, nil, err
 	}
 
 	switch top_k_type {
@@ -540,11 +907,17 @@ type SearchResult struct {
 
 type SearchResults []SearchResult
 
-func (l SearchResults) Len() int           { return len(l) }
-func (l SearchResults) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
-func (l SearchResults) Less(i, j int) bool { return l[i].Score > l[j].Score }
+func (l SearchResults) Len() int      { return len(l) }
+func (l SearchResults) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l SearchResults) Less(i, j int) bool {
+	return l[i].Score > l[j].Score ||
+		math.IsNaN(l[j].Score) && !math.IsNaN(l[i].Score)
+}
 
-func (d *Data) search(proj_id int64,
+// search scores every sample in the project with searchParallelism workers.
+// It stops handing out samples once ctx is canceled, and reports how many
+// samples have been scored to the ctx's Progress, if any.
+func (d *Data) search(ctx context.Context, proj_id int64,
 	scoreFunc func(sample_id int64) (score float64, err error)) (
 	SearchResults, error) {
 
@@ -554,6 +927,9 @@ func (d *Data) search(proj_id int64,
 		return nil, Err.Wrap(err)
 	}
 
+	progress := ProgressFromContext(ctx)
+	progress.Start(len(samples))
+
 	var wg sync.WaitGroup
 	var result_mtx sync.Mutex
 	result := make(SearchResults, 0, len(samples))
@@ -572,16 +948,26 @@ func (d *Data) search(proj_id int64,
 					result = append(result, SearchResult{Sample: sample, Score: val})
 				}
 				result_mtx.Unlock()
+				progress.Add(1)
 			}
 		}()
 	}
 
+feed:
 	for _, sample := range samples {
-		samples_ch <- sample
+		select {
+		case samples_ch <- sample:
+		case <-ctx.Done():
+			break feed
+		}
 	}
 	close(samples_ch)
 	wg.Wait()
 
+	if ctx.Err() != nil {
+		return nil, ErrCanceled.Wrap(ctx.Err())
+	}
+
 	err = result_errs.Finalize()
 	if err != nil {
 		return nil, err
@@ -591,8 +977,8 @@ func (d *Data) search(proj_id int64,
 	return result, nil
 }
 
-func (d *Data) TopKSearch(proj_id int64, up, down []int64, k int,
-	top_k_type TopKType) (result SearchResults, err error) {
+func (d *Data) TopKSearch(ctx context.Context, proj_id int64,
+	up, down []int64, k int, top_k_type TopKType) (result SearchResults, err error) {
 	up_lookup := make(map[int64]bool, len(up))
 	down_lookup := make(map[int64]bool, len(down))
 	for _, id := range up {
@@ -601,7 +987,7 @@ func (d *Data) TopKSearch(proj_id int64, up, down []int64, k int,
 	for _, id := range down {
 		down_lookup[id] = true
 	}
-	return d.search(proj_id, func(sample_id int64) (float64, error) {
+	return d.search(ctx, proj_id, func(sample_id int64) (float64, error) {
 		other_up, other_down, err := d.TopKSignature(sample_id, k, top_k_type)
 		if err != nil {
 			return math.NaN(), err
@@ -627,7 +1013,48 @@ func (d *Data) TopKSearch(proj_id int64, up, down []int64, k int,
 	})
 }
 
-func (d *Data) KSSearch(proj_id int64, up, down []int64) (
+// SampleSignature returns the sample's rank or value differences, for use as
+// an XSum query.
+func (d *Data) SampleSignature(sample_id int64, top_k_type TopKType) (
+	map[int64]float64, error) {
+	values, err := d.SampleValues(sample_id)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[int64]float64, len(values))
+	for _, val := range values {
+		if top_k_type == TopKValueDiff {
+			rv[val.DimensionId] = val.ValueDiff
+		} else {
+			rv[val.DimensionId] = float64(val.RankDiff)
+		}
+	}
+	return rv, nil
+}
+
+// XSumSearch scores each sample by the extreme sum of the query signature:
+// the sum of the query's values over the sample's top-n up-regulated
+// dimensions, minus the sum over its top-n down-regulated dimensions.
+func (d *Data) XSumSearch(ctx context.Context, proj_id int64,
+	query map[int64]float64, n int, top_k_type TopKType) (result SearchResults, err error) {
+	return d.search(ctx, proj_id, func(sample_id int64) (float64, error) {
+		up, down, err := d.TopKSignature(sample_id, n, top_k_type)
+		if err != nil {
+			return math.NaN(), err
+		}
+		val := 0.0
+		for _, id := range up {
+			val += query[id]
+		}
+		for _, id := range down {
+			val -= query[id]
+		}
+		return val, nil
+	})
+}
+
+func (d *Data) KSSearch(ctx context.Context, proj_id int64,
+	up, down []int64) (
 	result SearchResults, err error) {
 	return nil, errors.NotImplementedError.New("TODO")
 
@@ -640,7 +1067,7 @@ func (d *Data) KSSearch(proj_id int64, up, down []int64) (
 		down_lookup[id] = true
 	}
 
-	return d.search(proj_id, func(sample_id int64) (float64, error) {
+	return d.search(ctx, proj_id, func(sample_id int64) (float64, error) {
 		var values []SampleValue
 		err = d.db.Where("sample_id = ?", sample_id).Order(
 			"diff desc").Find(&values).Error
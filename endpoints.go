@@ -4,11 +4,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"gopkg.in/webhelp.v1/whcompat"
@@ -18,42 +22,123 @@ import (
 )
 
 const (
-	DefaultLimit = 25
+	DefaultLimit      = 25
+	RecentSearchLimit = 50
+
+	maxFormMemory = 32 << 20
 )
 
 type Endpoints struct {
-	Data *Data
+	Data       *Data
+	Jobs       *SearchJobs
+	Recomputes *Recomputes
 }
 
 func NewEndpoints(data *Data) *Endpoints {
-	return &Endpoints{Data: data}
+	return &Endpoints{
+		Data:       data,
+		Jobs:       NewSearchJobs(data),
+		Recomputes: NewRecomputes(data)}
+}
+
+// Stop cancels background work and waits for it as long as ctx allows.
+func (a *Endpoints) Stop(ctx context.Context) {
+	a.Jobs.Stop(ctx)
+	a.Recomputes.Stop(ctx)
 }
 
 func (a *Endpoints) APIKeys(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
+	if user.Scoped() {
+		return "", nil, ErrDenied.New("api key can't manage api keys")
+	}
 	keys, err := a.Data.APIKeys(user.Id)
 	if err != nil {
 		return "", nil, err
 	}
+	projects, err := a.Data.Projects(user)
+	if err != nil {
+		return "", nil, err
+	}
+	project_names := make(map[int64]string, len(projects))
+	for _, proj := range projects {
+		project_names[proj.Id] = proj.Name
+	}
 	return "apikeys", map[string]interface{}{
-		"Keys": keys,
+		"Keys":         keys,
+		"Projects":     projects,
+		"ProjectNames": project_names,
+		"Now":          time.Now(),
 	}, nil
 }
 
-func (a *Endpoints) NewAPIKey(w http.ResponseWriter, req *http.Request,
+func (a *Endpoints) NewAPIKey(ctx context.Context, req *http.Request,
+	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
+	if user.Scoped() {
+		return "", nil, ErrDenied.New("api key can't manage api keys")
+	}
+	name := strings.TrimSpace(req.FormValue("name"))
+	if name == "" {
+		return "", nil, wherr.BadRequest.New("api keys need a name")
+	}
+	var expires_at *time.Time
+	if req.FormValue("expires") != "" {
+		expires, err := time.Parse("2006-01-02", req.FormValue("expires"))
+		if err != nil {
+			return "", nil, wherr.BadRequest.New("invalid expiration date")
+		}
+		if !expires.After(time.Now()) {
+			return "", nil, wherr.BadRequest.New("expiration date has passed")
+		}
+		expires_at = &expires
+	}
+
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
+	}
+	var project_ids []int64
+	for _, val := range form["project"] {
+		id, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return "", nil, wherr.BadRequest.New("invalid project")
+		}
+		_, _, err = a.Data.Project(user, id)
+		if err != nil {
+			return "", nil, err
+		}
+		project_ids = append(project_ids, id)
+	}
+
+	key, err := a.Data.NewAPIKey(user, name, expires_at,
+		req.FormValue("access") == "read", project_ids)
+	if err != nil {
+		return "", nil, err
+	}
+	return "apikey", map[string]interface{}{
+		"Name":      name,
+		"Key":       key,
+		"ExpiresAt": expires_at,
+	}, nil
+}
+
+func (a *Endpoints) RevokeAPIKey(w http.ResponseWriter, req *http.Request,
 	user *UserInfo) {
-	_, err := a.Data.NewAPIKey(user.Id)
+	if user.Scoped() {
+		whfatal.Error(ErrDenied.New("api key can't manage api keys"))
+	}
+	err := a.Data.RevokeAPIKey(user,
+		apiKeyId.MustGet(whcompat.Context(req)))
 	if err != nil {
 		whfatal.Error(err)
 	}
-
-	whredir.Redirect(w, req, fmt.Sprintf("/account/apikeys"))
+	whredir.Redirect(w, req, "/account/apikeys")
 }
 
 func (a *Endpoints) ProjectList(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{},
 	err error) {
-	projects, err := a.Data.Projects(user.Id)
+	projects, err := a.Data.Projects(user)
 	if err != nil {
 		return "", nil, err
 	}
@@ -63,7 +148,7 @@ func (a *Endpoints) ProjectList(ctx context.Context, req *http.Request,
 
 func (a *Endpoints) Project(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
-	proj, read_only, err := a.Data.Project(user.Id, projectId.MustGet(ctx))
+	proj, read_only, err := a.Data.Project(user, projectId.MustGet(ctx))
 	if err != nil {
 		return "", nil, wherr.NotFound.Wrap(err)
 	}
@@ -82,7 +167,28 @@ func (a *Endpoints) Project(ctx context.Context, req *http.Request,
 
 func (a *Endpoints) NewProject(w http.ResponseWriter, req *http.Request,
 	user *UserInfo) {
-	proj_id, err := a.Data.NewProject(user.Id, req.FormValue("name"),
+	observeUpload("project", req)
+	proj_id, err := a.Data.NewProject(user, req.FormValue("name"),
+		func(deliver func(dim string) error) error {
+			for _, dim := range strings.Fields(req.FormValue("dimensions")) {
+				err := deliver(dim)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		whfatal.Error(err)
+	}
+	whredir.Redirect(w, req, fmt.Sprintf("/project/%d", proj_id))
+}
+
+func (a *Endpoints) AddDimensions(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	observeUpload("dimensions", req)
+	proj_id := projectId.MustGet(whcompat.Context(req))
+	_, err := a.Data.AddDimensions(user, proj_id,
 		func(deliver func(dim string) error) error {
 			for _, dim := range strings.Fields(req.FormValue("dimensions")) {
 				err := deliver(dim)
@@ -100,12 +206,17 @@ func (a *Endpoints) NewProject(w http.ResponseWriter, req *http.Request,
 
 func (a *Endpoints) Sample(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
-	proj, sample, err := a.Data.Sample(user.Id, projectId.MustGet(ctx),
+	proj, sample, err := a.Data.Sample(user, projectId.MustGet(ctx),
 		sampleId.MustGet(ctx))
 	if err != nil {
 		return "", nil, wherr.NotFound.Wrap(err)
 	}
-	values, err := a.Data.SampleValues(sample.Id)
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
+	}
+	pager := parsePager(form, sampleValueSorts, "rank_diff", true)
+	values, err := a.Data.SampleValuesPage(sample.Id, pager)
 	if err != nil {
 		return "", nil, err
 	}
@@ -113,17 +224,198 @@ func (a *Endpoints) Sample(ctx context.Context, req *http.Request,
 	if err != nil {
 		return "", nil, err
 	}
+	_, read_only, err := a.Data.Project(user, proj.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	controls, err := a.Data.Controls(proj.Id)
+	if err != nil {
+		return "", nil, err
+	}
 
 	return "sample", map[string]interface{}{
-		"Project": proj,
-		"Sample":  sample,
-		"Values":  values,
-		"Lookup":  dimlookup}, nil
+		"Project":       proj,
+		"ReadOnly":      read_only,
+		"Controls":      controls,
+		"Sample":        sample,
+		"Normalization": Normalization(sample.Normalization),
+		"DiffType":      DiffType(sample.DiffType),
+		"Values":        values,
+		"Pager":         pager,
+		"Lookup":        dimlookup}, nil
+}
+
+// MoveSample moves a sample to the control given by the "control" form
+// value.
+func (a *Endpoints) MoveSample(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	ctx := whcompat.Context(req)
+	proj_id, sample_id := projectId.MustGet(ctx), sampleId.MustGet(ctx)
+	control_id, err := strconv.ParseInt(req.FormValue("control"), 10, 64)
+	if err != nil {
+		whfatal.Error(wherr.BadRequest.New("invalid control id"))
+	}
+	err = a.Data.MoveSample(user, proj_id, sample_id, control_id)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	whredir.Redirect(w, req, fmt.Sprintf("/project/%d/sample/%d",
+		proj_id, sample_id))
+}
+
+// SamplePlot serves an SVG plot of the sample's values. The plot type is
+// one of "scatter" (value against control value), "waterfall" (rank
+// differences) or "histogram" (value differences).
+func (a *Endpoints) SamplePlot(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	ctx := whcompat.Context(req)
+	_, sample, err := a.Data.Sample(user, projectId.MustGet(ctx),
+		sampleId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	values, err := a.Data.SampleValues(sample.Id)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	var svg []byte
+	switch req.FormValue("type") {
+	case "scatter":
+		control_lookup, err := a.Data.SampleReferenceValues(sample)
+		if err != nil {
+			whfatal.Error(err)
+		}
+		xs := make([]float64, 0, len(values))
+		ys := make([]float64, 0, len(values))
+		for _, val := range values {
+			control, exists := control_lookup[val.DimensionId]
+			if !exists {
+				continue
+			}
+			xs, ys = append(xs, control.Value), append(ys, val.Value)
+		}
+		svg = ScatterPlot(xs, ys, "Value vs. control value", "control value",
+			"sample value")
+	case "waterfall":
+		diffs := make([]float64, len(values))
+		for i, val := range values {
+			diffs[i] = float64(val.RankDiff)
+		}
+		svg = WaterfallPlot(diffs, "Rank differences", "dimensions",
+			"rank difference")
+	case "histogram":
+		diffs := make([]float64, len(values))
+		for i, val := range values {
+			diffs[i] = val.ValueDiff
+		}
+		svg = HistogramPlot(diffs, histogramBins, "Value differences",
+			"value difference")
+	default:
+		whfatal.Error(wherr.BadRequest.New("unknown plot type"))
+	}
+	writeSVG(w, svg)
 }
 
+// ControlPlot serves an SVG plot of the control's values, either "waterfall"
+// (values by rank) or "histogram".
+func (a *Endpoints) ControlPlot(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	ctx := whcompat.Context(req)
+	_, control, _, err := a.Data.Control(user, projectId.MustGet(ctx),
+		controlId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	values, err := a.Data.ControlValues(control.Id)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	vals := make([]float64, len(values))
+	for i, val := range values {
+		vals[i] = val.Value
+	}
+	var svg []byte
+	switch req.FormValue("type") {
+	case "waterfall":
+		svg = WaterfallPlot(vals, "Values by rank", "dimensions", "value")
+	case "histogram":
+		svg = HistogramPlot(vals, histogramBins, "Values", "value")
+	default:
+		whfatal.Error(wherr.BadRequest.New("unknown plot type"))
+	}
+	writeSVG(w, svg)
+}
+
+func writeSVG(w http.ResponseWriter, svg []byte) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	_, err := w.Write(svg)
+	if err != nil {
+		whfatal.Error(err)
+	}
+}
+
+// Compare compares samples a and b of the project. Either may be left out,
+// in which case only the form to pick them is shown.
+func (a *Endpoints) Compare(ctx context.Context, req *http.Request,
+	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
+	proj, _, err := a.Data.Project(user, projectId.MustGet(ctx))
+	if err != nil {
+		return "", nil, wherr.NotFound.Wrap(err)
+	}
+	_, samples, _, err := a.Data.ProjectInfo(proj.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
+	}
+	limit, err := strconv.Atoi(form.Get("k"))
+	if err != nil || limit <= 0 {
+		limit = DefaultLimit
+	}
+	topk_type, topk_type_str := topKType(form)
+	page = map[string]interface{}{
+		"Project":  proj,
+		"Samples":  samples,
+		"K":        limit,
+		"TopKType": topk_type_str}
+
+	a_id, a_err := strconv.ParseInt(form.Get("a"), 10, 64)
+	b_id, b_err := strconv.ParseInt(form.Get("b"), 10, 64)
+	if a_err != nil || b_err != nil {
+		page["A"], page["B"] = a_id, b_id
+		return "compare", page, nil
+	}
+	_, sample_a, err := a.Data.Sample(user, proj.Id, a_id)
+	if err != nil {
+		return "", nil, wherr.NotFound.Wrap(err)
+	}
+	_, sample_b, err := a.Data.Sample(user, proj.Id, b_id)
+	if err != nil {
+		return "", nil, wherr.NotFound.Wrap(err)
+	}
+	comparison, err := a.Data.Compare(sample_a.Id, sample_b.Id, limit,
+		topk_type)
+	if err != nil {
+		return "", nil, err
+	}
+	dimlookup, err := a.Data.DimLookup(proj.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	page["A"], page["B"] = sample_a.Id, sample_b.Id
+	page["SampleA"], page["SampleB"] = sample_a, sample_b
+	page["Comparison"] = comparison
+	page["Lookup"] = dimlookup
+	return "compare", page, nil
+}
+
+// SampleSimilar shows the form for searching for samples like the sample.
+// The search runs as a search job, submitted by SearchSimilar.
 func (a *Endpoints) SampleSimilar(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
-	proj, sample, err := a.Data.Sample(user.Id, projectId.MustGet(ctx),
+	proj, sample, err := a.Data.Sample(user, projectId.MustGet(ctx),
 		sampleId.MustGet(ctx))
 	if err != nil {
 		return "", nil, wherr.NotFound.Wrap(err)
@@ -134,56 +426,166 @@ func (a *Endpoints) SampleSimilar(ctx context.Context, req *http.Request,
 		limit = DefaultLimit
 	}
 
-	var topk_type TopKType
-	topk_type_str := req.FormValue("topk-type")
-	switch topk_type_str {
-	case "valdiff":
-		topk_type = TopKValueDiff
-	default:
-		topk_type = TopKRankDiff
-		topk_type_str = "rankdiff"
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
 	}
+	_, topk_type_str := topKType(form)
 
-	up_regulated, down_regulated, err := a.Data.TopKSignature(sample.Id, limit,
-		topk_type)
+	weight, err := enrichmentWeight(form)
 	if err != nil {
 		return "", nil, err
 	}
 
-	var results SearchResults
 	search_type := req.FormValue("search-type")
-	switch search_type {
-	case "kolmogorov":
-		results, err = a.Data.KSSearch(proj.Id, up_regulated, down_regulated)
-	default:
+	if search_type == "" {
 		search_type = "topk"
-		results, err = a.Data.TopKSearch(proj.Id, up_regulated, down_regulated,
-			limit, topk_type)
-	}
-	if err != nil {
-		return "", nil, err
 	}
 
 	return "similar", map[string]interface{}{
-		"Project": proj,
-		"Sample":  sample,
-		"Results": results,
-		"Params": url.Values{
-			"k":           []string{fmt.Sprint(limit)},
-			"search-type": []string{search_type},
-			"topk-type":   []string{topk_type_str},
-		}.Encode(),
+		"Project":    proj,
+		"Sample":     sample,
+		"K":          limit,
+		"SearchType": search_type,
+		"TopKType":   topk_type_str,
+		"Weight":     weight,
 	}, nil
 }
 
+// sampleSearchFields are the form values of a search for samples like a
+// sample, other than the sample itself.
+var sampleSearchFields = []string{"search-type", "topk-type", "k", "weight"}
+
+// SearchSimilar submits a search for samples like the sample, from its
+// Similar Samples tab.
+func (a *Endpoints) SearchSimilar(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	ctx := whcompat.Context(req)
+	proj, sample, err := a.Data.Sample(user, projectId.MustGet(ctx),
+		sampleId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	form, err := parseForm(req)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	params := url.Values{
+		"sample":      []string{strconv.FormatInt(sample.Id, 10)},
+		"search-type": []string{"topk"}}
+	for _, field := range sampleSearchFields {
+		if form.Get(field) != "" {
+			params.Set(field, form.Get(field))
+		}
+	}
+	a.submitSearch(w, req, user, proj, params)
+}
+
+// parseSampleSearch builds a search for samples like the form's sample. The
+// sample's signature is taken when the search is submitted.
+func (a *Endpoints) parseSampleSearch(form url.Values, user *UserInfo,
+	proj *Project, topk_type TopKType) (
+	run searchFunc, detail_params string, err error) {
+	sample_id, err := strconv.ParseInt(form.Get("sample"), 10, 64)
+	if err != nil {
+		return nil, "", wherr.BadRequest.New("invalid sample parameter")
+	}
+	_, sample, err := a.Data.Sample(user, proj.Id, sample_id)
+	if err != nil {
+		return nil, "", wherr.NotFound.Wrap(err)
+	}
+
+	search_type := form.Get("search-type")
+	if corr_type := CorrelationType(search_type); corr_type.Valid() {
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.CorrelationSearch(ctx, proj.Id, sample.Id, corr_type,
+				topk_type)
+		}, "", nil
+	}
+
+	limit, err := strconv.Atoi(form.Get("k"))
+	if err != nil || limit <= 0 {
+		return nil, "", wherr.BadRequest.New("invalid k parameter")
+	}
+
+	if search_type == "xsum" {
+		query, err := a.Data.SampleSignature(sample.Id, topk_type)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.XSumSearch(ctx, proj.Id, query, limit, topk_type)
+		}, "", nil
+	}
+
+	up_regulated, down_regulated, err := a.Data.TopKSignature(sample.Id,
+		limit, topk_type)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch search_type {
+	case "kolmogorov":
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.KSSearch(ctx, proj.Id, up_regulated, down_regulated)
+		}, "", nil
+	case "gsea":
+		weight, err := enrichmentWeight(form)
+		if err != nil {
+			return nil, "", err
+		}
+		detail_params, err = a.enrichmentParams(proj.Id, up_regulated,
+			down_regulated, weight)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.EnrichmentSearch(ctx, proj.Id, up_regulated,
+				down_regulated, weight)
+		}, detail_params, nil
+	case "topk":
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.TopKSearch(ctx, proj.Id, up_regulated, down_regulated,
+				limit, topk_type)
+		}, "", nil
+	}
+	return nil, "", wherr.BadRequest.New("invalid search-type parameter")
+}
+
+func (a *Endpoints) enrichmentParams(proj_id int64, up, down []int64,
+	weight float64) (string, error) {
+	dimlookup, err := a.Data.DimLookup(proj_id)
+	if err != nil {
+		return "", err
+	}
+	up_names, err := lookupNames(dimlookup, up)
+	if err != nil {
+		return "", err
+	}
+	down_names, err := lookupNames(dimlookup, down)
+	if err != nil {
+		return "", err
+	}
+	return url.Values{
+		"up":     []string{strings.Join(up_names, " ")},
+		"down":   []string{strings.Join(down_names, " ")},
+		"weight": []string{fmt.Sprint(weight)},
+	}.Encode(), nil
+}
+
 func (a *Endpoints) Control(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
-	proj, control, read_only, err := a.Data.Control(user.Id,
+	proj, control, read_only, err := a.Data.Control(user,
 		projectId.MustGet(ctx), controlId.MustGet(ctx))
 	if err != nil {
 		return "", nil, wherr.NotFound.Wrap(err)
 	}
-	values, err := a.Data.ControlValues(control.Id)
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
+	}
+	pager := parsePager(form, controlValueSorts, "rank", true)
+	values, err := a.Data.ControlValuesPage(control.Id, pager)
 	if err != nil {
 		return "", nil, err
 	}
@@ -191,105 +593,177 @@ func (a *Endpoints) Control(ctx context.Context, req *http.Request,
 	if err != nil {
 		return "", nil, err
 	}
+	controls, err := a.Data.Controls(proj.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	if done, total, running := a.Recomputes.Status(control.Id); running {
+		control.RecomputeStatus = RecomputeRunning
+		control.RecomputeDone, control.RecomputeTotal = done, total
+	}
 
 	return "control", map[string]interface{}{
-		"Project":  proj,
-		"ReadOnly": read_only,
-		"Control":  control,
-		"Values":   values,
-		"Lookup":   dimlookup}, nil
+		"Project":        proj,
+		"ReadOnly":       read_only,
+		"Control":        control,
+		"Controls":       controls,
+		"Normalizations": Normalizations,
+		"DiffTypes":      []DiffType{DiffValue, DiffZScore},
+		"Values":         values,
+		"Pager":          pager,
+		"Lookup":         dimlookup}, nil
 }
 
 func (a *Endpoints) NewControl(w http.ResponseWriter, req *http.Request,
-	user *UserInfo) {
+	user *UserInfo, upload *Upload) {
+	observeUpload("control", req)
 	proj_id := projectId.MustGet(whcompat.Context(req))
-	control_id, err := a.Data.NewControl(user.Id, proj_id, req.FormValue("name"),
-		func(deliver func(dim_id int64, value float64) error) error {
-			dimlookup, err := a.Data.DimLookup(proj_id)
-			if err != nil {
-				return err
-			}
+	aggregate, err := parseAggregate(upload.Fields)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	control_id, err := a.Data.NewControl(user, proj_id,
+		upload.Fields.Get("name"), aggregate,
+		a.uploadedReplicates(proj_id, upload))
+	if err != nil {
+		whfatal.Error(err)
+	}
+	whredir.Redirect(w, req, fmt.Sprintf("/project/%d/control/%d",
+		proj_id, control_id))
+}
 
-			for _, row := range strings.Split(req.FormValue("values"), "\n") {
-				fields := strings.Fields(row)
-				if len(fields) == 0 {
-					continue
-				}
-				if len(fields) != 2 {
-					return wherr.BadRequest.New("malformed data: %#v", row)
-				}
-				id, err := dimlookup.LookupId(fields[0])
-				if err != nil {
-					return err
-				}
-				val, err := strconv.ParseFloat(fields[1], 64)
-				if err != nil {
-					return wherr.BadRequest.New("malformed data: %#v", row)
-				}
-				err = deliver(id, val)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
+// ReplaceControlValues replaces a control's values and starts recomputing
+// its samples against them.
+func (a *Endpoints) ReplaceControlValues(w http.ResponseWriter,
+	req *http.Request, user *UserInfo, upload *Upload) {
+	observeUpload("control", req)
+	ctx := whcompat.Context(req)
+	proj_id, control_id := projectId.MustGet(ctx), controlId.MustGet(ctx)
+	aggregate, err := parseAggregate(upload.Fields)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	err = a.Data.ReplaceControlValues(user, proj_id, control_id, aggregate,
+		a.uploadedReplicates(proj_id, upload))
 	if err != nil {
 		whfatal.Error(err)
 	}
+	err = a.Recomputes.Start(user, proj_id, control_id)
+	if err != nil {
+		ferr := a.Data.FailRecompute(control_id, err)
+		if ferr != nil {
+			log.Printf("failed storing recompute of control %d: %v",
+				control_id, ferr)
+		}
+		whfatal.Error(err)
+	}
 	whredir.Redirect(w, req, fmt.Sprintf("/project/%d/control/%d",
 		proj_id, control_id))
 }
 
+// RecomputeControl recomputes a control's samples against its current
+// values, such as after an interrupted recompute.
+func (a *Endpoints) RecomputeControl(w http.ResponseWriter,
+	req *http.Request, user *UserInfo) {
+	ctx := whcompat.Context(req)
+	proj_id, control_id := projectId.MustGet(ctx), controlId.MustGet(ctx)
+	err := a.Data.AssertWriteAccess(user, proj_id, &control_id)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	err = a.Recomputes.Start(user, proj_id, control_id)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	whredir.Redirect(w, req, fmt.Sprintf("/project/%d/control/%d",
+		proj_id, control_id))
+}
+
+func (a *Endpoints) RecomputeProgress(w http.ResponseWriter,
+	req *http.Request, user *UserInfo) {
+	ctx := whcompat.Context(req)
+	_, control, _, err := a.Data.Control(user, projectId.MustGet(ctx),
+		controlId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	status, msg := control.RecomputeStatus, control.RecomputeError
+	done, total, running := a.Recomputes.Status(control.Id)
+	if running {
+		status, msg = RecomputeRunning, ""
+	} else {
+		done, total = control.RecomputeDone, control.RecomputeTotal
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"error":  msg,
+		"done":   done,
+		"total":  total})
+	if err != nil {
+		whfatal.Error(err)
+	}
+}
+
+func parseAggregate(form url.Values) (Aggregate, error) {
+	aggregate := AggregateMean
+	if val := form.Get("aggregate"); val != "" {
+		aggregate = Aggregate(val)
+	}
+	if !aggregate.Valid() {
+		return "", wherr.BadRequest.New("unknown aggregate %#v",
+			string(aggregate))
+	}
+	return aggregate, nil
+}
+
+// uploadedReplicates returns a func that delivers the upload's replicate
+// values as they are read.
+func (a *Endpoints) uploadedReplicates(proj_id int64, upload *Upload) func(
+	deliver func(dim_id int64, replicates []float64) error) error {
+	return func(deliver func(dim_id int64, replicates []float64) error) error {
+		dimlookup, err := a.Data.DimLookup(proj_id)
+		if err != nil {
+			return err
+		}
+		return upload.ParseReplicates(dimlookup, deliver)
+	}
+}
+
 func (a *Endpoints) NewSample(w http.ResponseWriter, req *http.Request,
-	user *UserInfo) {
+	user *UserInfo, upload *Upload) {
 	ctx := whcompat.Context(req)
-	a.newSample(ctx, w, req, user, projectId.MustGet(ctx),
+	a.newSample(ctx, w, req, user, upload, projectId.MustGet(ctx),
 		controlId.MustGet(ctx))
 }
 
 func (a *Endpoints) NewSampleFromName(w http.ResponseWriter, req *http.Request,
-	user *UserInfo) {
+	user *UserInfo, upload *Upload) {
 	ctx := whcompat.Context(req)
 	proj_id := projectId.MustGet(ctx)
 	control, err := a.Data.ControlByName(proj_id, controlName.Get(ctx))
 	if err != nil {
 		whfatal.Error(err)
 	}
-	a.newSample(ctx, w, req, user, proj_id, control.Id)
+	a.newSample(ctx, w, req, user, upload, proj_id, control.Id)
 }
 
 func (a *Endpoints) newSample(ctx context.Context, w http.ResponseWriter,
-	req *http.Request, user *UserInfo, proj_id, control_id int64) {
-	sample_id, err := a.Data.NewSample(user.Id, proj_id, control_id,
-		req.FormValue("name"),
-		func(deliver func(dim_id int64, value float64) error) error {
-			dimlookup, err := a.Data.DimLookup(proj_id)
-			if err != nil {
-				return err
-			}
-			for _, row := range strings.Split(req.FormValue("values"), "\n") {
-				fields := strings.Fields(row)
-				if len(fields) == 0 {
-					continue
-				}
-				if len(fields) != 2 {
-					return wherr.BadRequest.New("malformed data: %#v", row)
-				}
-				id, err := dimlookup.LookupId(fields[0])
-				if err != nil {
-					return err
-				}
-				val, err := strconv.ParseFloat(fields[1], 64)
-				if err != nil {
-					return wherr.BadRequest.New("malformed data: %#v", row)
-				}
-				err = deliver(id, val)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
+	req *http.Request, user *UserInfo, upload *Upload,
+	proj_id, control_id int64) {
+	observeUpload("sample", req)
+	opts, err := parseNormalize(upload.Fields)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	diff_type := DiffType(upload.Fields.Get("diff-type"))
+	if !diff_type.Valid() {
+		whfatal.Error(wherr.BadRequest.New("unknown diff type %#v",
+			string(diff_type)))
+	}
+	sample_id, err := a.Data.NewSample(user, proj_id, control_id,
+		upload.Fields.Get("name"), opts, diff_type,
+		a.uploadedValues(proj_id, upload))
 	if err != nil {
 		whfatal.Error(err)
 	}
@@ -297,22 +771,164 @@ func (a *Endpoints) newSample(ctx context.Context, w http.ResponseWriter,
 		proj_id, sample_id))
 }
 
-func (a *Endpoints) Search(ctx context.Context, req *http.Request,
+// parseNormalize reads the "normalization" form value and, for
+// normalizations that need them, the "norm-controls" reference control ids.
+func parseNormalize(form url.Values) (opts NormalizeOptions, err error) {
+	opts.Method = Normalization(form.Get("normalization"))
+	if !opts.Method.Valid() {
+		return opts, wherr.BadRequest.New("unknown normalization %#v",
+			string(opts.Method))
+	}
+	if opts.Method != NormRobustZ {
+		return opts, nil
+	}
+	for _, val := range form["norm-controls"] {
+		id, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return opts, wherr.BadRequest.New("invalid control id %#v", val)
+		}
+		opts.Controls = append(opts.Controls, id)
+	}
+	return opts, nil
+}
+
+// uploadedValues returns a func that delivers the upload's values as they are
+// read.
+func (a *Endpoints) uploadedValues(proj_id int64, upload *Upload) func(
+	deliver func(dim_id int64, value float64) error) error {
+	return func(deliver func(dim_id int64, value float64) error) error {
+		dimlookup, err := a.Data.DimLookup(proj_id)
+		if err != nil {
+			return err
+		}
+		return upload.ParseValues(dimlookup, deliver)
+	}
+}
+
+type searchFunc func(ctx context.Context) (SearchResults, error)
+
+// searchFields are the form values that make up a search, and are stored
+// with it so it can be shown and run again later.
+var searchFields = []string{"search-type", "topk-type", "k", "weight",
+	"up-regulated", "down-regulated", "signature"}
+
+func (a *Endpoints) Search(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	proj, _, err := a.Data.Project(user,
+		projectId.MustGet(whcompat.Context(req)))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	form, err := parseForm(req)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	params := url.Values{}
+	for _, field := range searchFields {
+		if form.Get(field) != "" {
+			params.Set(field, form.Get(field))
+		}
+	}
+	a.submitSearch(w, req, user, proj, params)
+}
+
+func (a *Endpoints) RerunSearchJob(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	ctx := whcompat.Context(req)
+	proj, job, err := a.Data.SearchJob(user, projectId.MustGet(ctx),
+		searchJobId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	params, err := url.ParseQuery(job.Params)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	a.submitSearch(w, req, user, proj, params)
+}
+
+func (a *Endpoints) submitSearch(w http.ResponseWriter, req *http.Request,
+	user *UserInfo, proj *Project, params url.Values) {
+	run, detail_params, err := a.parseSearch(params, user, proj)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	user_id := ""
+	if user != nil {
+		user_id = user.Id
+	}
+	job_id, err := a.Jobs.Submit(user_id, proj.Id, params.Get("search-type"),
+		params, detail_params, run)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	whredir.Redirect(w, req, fmt.Sprintf("/project/%d/search/%d",
+		proj.Id, job_id))
+}
+
+func (a *Endpoints) SearchHistory(ctx context.Context, req *http.Request,
 	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
-	proj, _, err := a.Data.Project(user.Id, projectId.MustGet(ctx))
+	proj, _, err := a.Data.Project(user, projectId.MustGet(ctx))
 	if err != nil {
 		return "", nil, wherr.NotFound.Wrap(err)
 	}
+	jobs, err := a.Data.RecentSearchJobs(user.Id, proj.Id, RecentSearchLimit)
+	if err != nil {
+		return "", nil, err
+	}
+	return "searches", map[string]interface{}{
+		"Project": proj,
+		"Jobs":    jobs}, nil
+}
 
-	up_regulated_strings := strings.Fields(req.FormValue("up-regulated"))
-	down_regulated_strings := strings.Fields(req.FormValue("down-regulated"))
-	if len(up_regulated_strings)+len(down_regulated_strings) == 0 {
-		return "", nil, wherr.BadRequest.New("no dimensions provided")
+// Activity shows the project's audit log. Only the owner can see it, as it
+// includes where changes were made from.
+func (a *Endpoints) Activity(ctx context.Context, req *http.Request,
+	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
+	proj, _, err := a.Data.Project(user, projectId.MustGet(ctx))
+	if err != nil {
+		return "", nil, wherr.NotFound.Wrap(err)
+	}
+	if user == nil || proj.UserId != user.Id {
+		return "", nil, ErrDenied.New("only the project owner can see activity")
+	}
+	events, err := a.Data.ProjectActivity(proj.Id, ActivityLimit)
+	if err != nil {
+		return "", nil, err
+	}
+	return "activity", map[string]interface{}{
+		"Project": proj,
+		"Events":  events}, nil
+}
+
+func parseForm(req *http.Request) (url.Values, error) {
+	err := req.ParseMultipartForm(maxFormMemory)
+	if err != nil && err != http.ErrNotMultipart {
+		return nil, bodyError(req, err)
+	}
+	return req.Form, nil
+}
+
+func (a *Endpoints) parseSearch(form url.Values, user *UserInfo,
+	proj *Project) (run searchFunc, detail_params string, err error) {
+	topk_type, _ := topKType(form)
+	if form.Get("sample") != "" {
+		return a.parseSampleSearch(form, user, proj, topk_type)
 	}
 
 	dimlookup, err := a.Data.DimLookup(proj.Id)
 	if err != nil {
-		return "", nil, err
+		return nil, "", err
+	}
+
+	if form.Get("search-type") == "xsum" {
+		return a.parseXSumSearch(form, proj, dimlookup, topk_type)
+	}
+
+	up_regulated_strings := strings.Fields(form.Get("up-regulated"))
+	down_regulated_strings := strings.Fields(form.Get("down-regulated"))
+	if len(up_regulated_strings)+len(down_regulated_strings) == 0 {
+		return nil, "", wherr.BadRequest.New("no dimensions provided")
 	}
 
 	seen := make(map[string]bool,
@@ -321,54 +937,264 @@ func (a *Endpoints) Search(ctx context.Context, req *http.Request,
 	down_regulated := make([]int64, 0, len(down_regulated_strings))
 	for _, val := range up_regulated_strings {
 		if seen[val] {
-			return "", nil, wherr.BadRequest.New("duplicated dimension")
+			return nil, "", wherr.BadRequest.New("duplicated dimension")
 		}
 		seen[val] = true
 		id, err := dimlookup.LookupId(val)
 		if err != nil {
-			return "", nil, err
+			return nil, "", err
 		}
 		up_regulated = append(up_regulated, id)
 	}
 	for _, val := range down_regulated_strings {
 		if seen[val] {
-			return "", nil, wherr.BadRequest.New("duplicated dimension")
+			return nil, "", wherr.BadRequest.New("duplicated dimension")
 		}
 		seen[val] = true
 		id, err := dimlookup.LookupId(val)
 		if err != nil {
-			return "", nil, err
+			return nil, "", err
 		}
 		down_regulated = append(down_regulated, id)
 	}
 
-	var topk_type TopKType
-	switch req.FormValue("topk-type") {
-	case "valdiff":
-		topk_type = TopKValueDiff
+	switch form.Get("search-type") {
+	case "kolmogorov":
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.KSSearch(ctx, proj.Id, up_regulated, down_regulated)
+		}, "", nil
+	case "topk":
+		limit, err := strconv.Atoi(form.Get("k"))
+		if err != nil {
+			return nil, "", wherr.BadRequest.New("invalid k parameter")
+		}
+		return func(ctx context.Context) (SearchResults, error) {
+			return a.Data.TopKSearch(ctx, proj.Id, up_regulated, down_regulated,
+				limit, topk_type)
+		}, "", nil
+	case "gsea":
+		weight, err := enrichmentWeight(form)
+		if err != nil {
+			return nil, "", err
+		}
+		return func(ctx context.Context) (SearchResults, error) {
+				return a.Data.EnrichmentSearch(ctx, proj.Id, up_regulated,
+					down_regulated, weight)
+			}, url.Values{
+				"up":     []string{strings.Join(up_regulated_strings, " ")},
+				"down":   []string{strings.Join(down_regulated_strings, " ")},
+				"weight": []string{fmt.Sprint(weight)},
+			}.Encode(), nil
 	default:
-		topk_type = TopKRankDiff
+		return nil, "", wherr.BadRequest.New("invalid search-type parameter")
 	}
+}
 
-	var results SearchResults
-	switch req.FormValue("search-type") {
-	case "kolmogorov":
-		results, err = a.Data.KSSearch(proj.Id, up_regulated, down_regulated)
-	case "topk":
-		limit, err := strconv.Atoi(req.FormValue("k"))
+func (a *Endpoints) parseXSumSearch(form url.Values, proj *Project,
+	dimlookup *DimLookup, topk_type TopKType) (
+	run searchFunc, detail_params string, err error) {
+	limit, err := strconv.Atoi(form.Get("k"))
+	if err != nil || limit <= 0 {
+		return nil, "", wherr.BadRequest.New("invalid k parameter")
+	}
+	query := map[int64]float64{}
+	for _, row := range strings.Split(form.Get("signature"), "\n") {
+		fields := strings.Fields(row)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, "", wherr.BadRequest.New("malformed signature: %#v", row)
+		}
+		id, err := dimlookup.LookupId(fields[0])
+		if err != nil {
+			return nil, "", err
+		}
+		if _, exists := query[id]; exists {
+			return nil, "", wherr.BadRequest.New("duplicated dimension")
+		}
+		query[id], err = strconv.ParseFloat(fields[1], 64)
 		if err != nil {
-			return "", nil, wherr.BadRequest.New("invalid k parameter")
+			return nil, "", wherr.BadRequest.New("malformed signature: %#v", row)
 		}
-		results, err = a.Data.TopKSearch(proj.Id, up_regulated, down_regulated,
-			limit, topk_type)
+	}
+	if len(query) == 0 {
+		return nil, "", wherr.BadRequest.New("no dimensions provided")
+	}
+
+	return func(ctx context.Context) (SearchResults, error) {
+		return a.Data.XSumSearch(ctx, proj.Id, query, limit, topk_type)
+	}, "", nil
+}
+
+func (a *Endpoints) SearchJob(ctx context.Context, req *http.Request,
+	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
+	proj, job, err := a.Data.SearchJob(user, projectId.MustGet(ctx),
+		searchJobId.MustGet(ctx))
+	if err != nil {
+		return "", nil, wherr.NotFound.Wrap(err)
+	}
+
+	status, scored, total, running := a.Jobs.Status(job.Id)
+	if running {
+		return "searchjob", map[string]interface{}{
+			"Project":   proj,
+			"Job":       job,
+			"Status":    status,
+			"Scored":    scored,
+			"Total":     total,
+			"CanCancel": user != nil && job.UserId == user.Id}, nil
+	}
+
+	results, err := a.Data.SearchJobResults(job.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
+	}
+	var sample *Sample
+	if job.Param("sample") != "" {
+		sample_id, err := strconv.ParseInt(job.Param("sample"), 10, 64)
+		if err == nil {
+			// the sample may have been deleted since.
+			_, sample, _ = a.Data.Sample(user, proj.Id, sample_id)
+		}
+	}
+	pager := parsePager(form, nil, "", false)
+	return "results", map[string]interface{}{
+		"Project":      proj,
+		"Sample":       sample,
+		"Job":          job,
+		"Results":      pager.Results(results),
+		"Pager":        pager,
+		"DetailParams": job.DetailParams}, nil
+}
+
+func (a *Endpoints) SearchJobProgress(w http.ResponseWriter,
+	req *http.Request, user *UserInfo) {
+	ctx := whcompat.Context(req)
+	_, job, err := a.Data.SearchJob(user, projectId.MustGet(ctx),
+		searchJobId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	status, scored, total, running := a.Jobs.Status(job.Id)
+	if !running {
+		status, scored, total = job.Status, job.Scored, job.Total
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"scored": scored,
+		"total":  total})
+	if err != nil {
+		whfatal.Error(err)
+	}
+}
+
+func (a *Endpoints) CancelSearchJob(w http.ResponseWriter, req *http.Request,
+	user *UserInfo) {
+	ctx := whcompat.Context(req)
+	proj, job, err := a.Data.SearchJob(user, projectId.MustGet(ctx),
+		searchJobId.MustGet(ctx))
+	if err != nil {
+		whfatal.Error(wherr.NotFound.Wrap(err))
+	}
+	if user == nil || job.UserId != user.Id {
+		whfatal.Error(ErrDenied.New("not your search"))
+	}
+	a.Jobs.Cancel(job.Id)
+	whredir.Redirect(w, req, fmt.Sprintf("/project/%d/search/%d",
+		proj.Id, job.Id))
+}
+
+func topKType(form url.Values) (topk_type TopKType, name string) {
+	switch form.Get("topk-type") {
+	case "valdiff":
+		return TopKValueDiff, "valdiff"
 	default:
-		return "", nil, wherr.BadRequest.New("invalid search-type parameter")
+		return TopKRankDiff, "rankdiff"
 	}
+}
+
+func enrichmentWeight(form url.Values) (float64, error) {
+	if form.Get("weight") == "" {
+		return DefaultEnrichmentWeight, nil
+	}
+	weight, err := strconv.ParseFloat(form.Get("weight"), 64)
+	if err != nil || weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return 0, wherr.BadRequest.New("invalid weight parameter")
+	}
+	return weight, nil
+}
+
+func (a *Endpoints) SampleEnrichment(ctx context.Context, req *http.Request,
+	user *UserInfo) (tmpl string, page map[string]interface{}, err error) {
+	proj, sample, err := a.Data.Sample(user, projectId.MustGet(ctx),
+		sampleId.MustGet(ctx))
+	if err != nil {
+		return "", nil, wherr.NotFound.Wrap(err)
+	}
+	dimlookup, err := a.Data.DimLookup(proj.Id)
 	if err != nil {
 		return "", nil, err
 	}
 
-	return "results", map[string]interface{}{
-		"Project": proj,
-		"Results": results}, nil
+	form, err := parseForm(req)
+	if err != nil {
+		return "", nil, err
+	}
+	weight, err := enrichmentWeight(form)
+	if err != nil {
+		return "", nil, err
+	}
+	up, err := lookupIds(dimlookup, strings.Fields(req.FormValue("up")))
+	if err != nil {
+		return "", nil, err
+	}
+	down, err := lookupIds(dimlookup, strings.Fields(req.FormValue("down")))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(up)+len(down) == 0 {
+		return "", nil, wherr.BadRequest.New("no dimensions provided")
+	}
+
+	enrichment, err := a.Data.Enrichment(sample.Id, up, down, weight)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "enrichment", map[string]interface{}{
+		"Project":    proj,
+		"Sample":     sample,
+		"Weight":     weight,
+		"Enrichment": enrichment,
+		"Lookup":     dimlookup}, nil
+}
+
+func lookupIds(dimlookup *DimLookup, names []string) ([]int64, error) {
+	ids := make([]int64, 0, len(names))
+	for _, name := range names {
+		id, err := dimlookup.LookupId(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func lookupNames(dimlookup *DimLookup, ids []int64) ([]string, error) {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		name, err := dimlookup.LookupName(id)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
 }
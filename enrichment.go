@@ -0,0 +1,179 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	DefaultEnrichmentWeight = 1.0
+)
+
+type EnrichmentSet struct {
+	Score       float64
+	LeadingEdge []int64
+	// Curve is the running sum at each position of the sample's dimensions,
+	// ordered by decreasing value difference.
+	Curve []float64
+}
+
+type Enrichment struct {
+	Score    float64
+	Up, Down *EnrichmentSet
+}
+
+// enrichmentSet computes a GSEA-style weighted enrichment score of set
+// against values, which must be sorted by decreasing value difference.
+// Hits step the running sum up by |ValueDiff|^weight (normalized), misses
+// step it down uniformly. A weight of 0 is the unweighted KS statistic.
+func enrichmentSet(values []SampleValue, set map[int64]bool,
+	weight float64) *EnrichmentSet {
+	if len(set) == 0 {
+		return nil
+	}
+	hit_total := 0.0
+	hits := 0
+	for _, val := range values {
+		if set[val.DimensionId] {
+			hit_total += math.Pow(math.Abs(val.ValueDiff), weight)
+			hits += 1
+		}
+	}
+	rv := &EnrichmentSet{Curve: make([]float64, len(values))}
+	misses := len(values) - hits
+	if hits == 0 || misses == 0 {
+		return rv
+	}
+
+	running, peak := 0.0, -1
+	for i, val := range values {
+		if set[val.DimensionId] {
+			if hit_total > 0 {
+				running += math.Pow(math.Abs(val.ValueDiff), weight) / hit_total
+			} else {
+				running += 1 / float64(hits)
+			}
+		} else {
+			running -= 1 / float64(misses)
+		}
+		rv.Curve[i] = running
+		if math.Abs(running) > math.Abs(rv.Score) {
+			rv.Score = running
+			peak = i
+		}
+	}
+
+	if peak < 0 {
+		return rv
+	}
+	if rv.Score > 0 {
+		for _, val := range values[:peak+1] {
+			if set[val.DimensionId] {
+				rv.LeadingEdge = append(rv.LeadingEdge, val.DimensionId)
+			}
+		}
+	} else {
+		for _, val := range values[peak:] {
+			if set[val.DimensionId] {
+				rv.LeadingEdge = append(rv.LeadingEdge, val.DimensionId)
+			}
+		}
+	}
+	return rv
+}
+
+func (d *Data) valuesByValueDiff(sample_id int64) (
+	values []SampleValue, err error) {
+	values, err = d.samples.get(d.db, sample_id)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(valueSorter{values: values, key: sampleValueKey("value_diff"),
+		desc: true})
+	return values, nil
+}
+
+func (d *Data) Enrichment(sample_id int64, up, down []int64,
+	weight float64) (*Enrichment, error) {
+	values, err := d.valuesByValueDiff(sample_id)
+	if err != nil {
+		return nil, err
+	}
+	return enrichment(values, idSet(up), idSet(down), weight), nil
+}
+
+func enrichment(values []SampleValue, up, down map[int64]bool,
+	weight float64) *Enrichment {
+	rv := &Enrichment{
+		Up:   enrichmentSet(values, up, weight),
+		Down: enrichmentSet(values, down, weight)}
+	if rv.Up != nil {
+		rv.Score += rv.Up.Score
+	}
+	if rv.Down != nil {
+		rv.Score -= rv.Down.Score
+	}
+	return rv
+}
+
+func (d *Data) EnrichmentSearch(ctx context.Context, proj_id int64,
+	up, down []int64, weight float64) (result SearchResults, err error) {
+	up_lookup, down_lookup := idSet(up), idSet(down)
+	return d.search(ctx, proj_id, func(sample_id int64) (float64, error) {
+		values, err := d.valuesByValueDiff(sample_id)
+		if err != nil {
+			return math.NaN(), err
+		}
+		return enrichment(values, up_lookup, down_lookup, weight).Score, nil
+	})
+}
+
+func idSet(ids []int64) map[int64]bool {
+	rv := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		rv[id] = true
+	}
+	return rv
+}
+
+// CurvePoints renders the curve as the points attribute of an SVG polyline
+// of the given size, with zero at the vertical center. Long curves are
+// bucketed, keeping the most extreme value of each bucket.
+func (s *EnrichmentSet) CurvePoints(width, height int) string {
+	if s == nil || len(s.Curve) == 0 {
+		return ""
+	}
+	buckets := len(s.Curve)
+	if buckets > width {
+		buckets = width
+	}
+	max := 0.0
+	for _, val := range s.Curve {
+		max = math.Max(max, math.Abs(val))
+	}
+	if max == 0 {
+		max = 1
+	}
+	points := make([]string, 0, buckets)
+	for b := 0; b < buckets; b++ {
+		start := b * len(s.Curve) / buckets
+		end := (b + 1) * len(s.Curve) / buckets
+		val := 0.0
+		for _, v := range s.Curve[start:end] {
+			if math.Abs(v) > math.Abs(val) {
+				val = v
+			}
+		}
+		x := float64(b) * float64(width) / float64(buckets)
+		y := float64(height)/2 - val/max*float64(height)/2
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(points, " ")
+}
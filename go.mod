@@ -0,0 +1,27 @@
+module github.com/jtolds/cwbench
+
+go 1.17
+
+require (
+	github.com/jinzhu/gorm v0.0.0-20170222002820-5409931a1bb8
+	github.com/lib/pq v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.0
+	github.com/prometheus/client_golang v1.9.0
+	github.com/spacemonkeygo/errors v0.0.0-20171212215202-9064522e9fd1
+	golang.org/x/net v0.11.0
+	gopkg.in/webhelp.v1 v1.0.0-20170530084242-3f30213e4c49
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.15.0 // indirect
+	github.com/prometheus/procfs v0.2.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	google.golang.org/protobuf v1.23.0 // indirect
+)
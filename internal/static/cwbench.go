@@ -0,0 +1,9 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package static
+
+func init() {
+	register("css/cwbench.css", `body { padding-top: 70px; }
+`)
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+//go:build ignore
+// +build ignore
+
+// gen.go downloads the assets listed in Upstream and writes them to
+// upstream_gen.go, so they are embedded in the binary.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+func main() {
+	err := generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func generate() error {
+	upstream, err := readUpstream("static.go")
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(upstream))
+	for name := range upstream {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gen.go. DO NOT EDIT.\n\n" +
+		"package static\n\nfunc init() {\n")
+	for _, name := range names {
+		resp, err := http.Get(upstream[name])
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", upstream[name], resp.Status)
+		}
+		fmt.Fprintf(&buf, "\tregister(%q, %q)\n", name, body)
+	}
+	buf.WriteString("}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile("upstream_gen.go", src, 0644)
+}
+
+// readUpstream pulls the Upstream map out of static.go, as gen.go can't
+// import the package it generates code for.
+func readUpstream(file string) (map[string]string, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[string]string{}
+	in_map := false
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "var Upstream = map[string]string{"):
+			in_map = true
+		case in_map && line == "}":
+			return rv, nil
+		case in_map && strings.HasPrefix(line, `"`):
+			var name, url string
+			_, err := fmt.Sscanf(strings.Replace(line, ":", " ", 1), "%q %q",
+				&name, &url)
+			if err != nil {
+				return nil, fmt.Errorf("bad Upstream line %q: %v", line, err)
+			}
+			rv[name] = url
+		}
+	}
+	return nil, fmt.Errorf("no Upstream map found in %s", file)
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+// Package static serves the UI's stylesheets, scripts and fonts from the
+// binary, so the UI works without access to the CDNs they come from.
+//
+// Third-party assets are pinned in Upstream and embedded by running
+// "go generate" (which needs network access once). An asset that is neither
+// embedded nor overridden is redirected to its upstream URL, as before they
+// were served locally, unless the handler is told not to.
+package static
+
+//go:generate go run gen.go
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CacheMaxAge = 24 * time.Hour
+)
+
+// Upstream lists where the third-party assets come from, by the path they
+// are served at.
+var Upstream = map[string]string{
+	"css/bootstrap.min.css": "https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/lumen/bootstrap.min.css",
+	"js/bootstrap.min.js":   "https://maxcdn.bootstrapcdn.com/bootstrap/3.3.6/js/bootstrap.min.js",
+	"js/jquery.min.js":      "https://ajax.googleapis.com/ajax/libs/jquery/1.11.3/jquery.min.js",
+	"js/html5shiv.min.js":   "https://oss.maxcdn.com/html5shiv/3.7.2/html5shiv.min.js",
+	"js/respond.min.js":     "https://oss.maxcdn.com/respond/1.4.2/respond.min.js",
+
+	"fonts/glyphicons-halflings-regular.eot":   "https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/fonts/glyphicons-halflings-regular.eot",
+	"fonts/glyphicons-halflings-regular.svg":   "https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/fonts/glyphicons-halflings-regular.svg",
+	"fonts/glyphicons-halflings-regular.ttf":   "https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/fonts/glyphicons-halflings-regular.ttf",
+	"fonts/glyphicons-halflings-regular.woff":  "https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/fonts/glyphicons-halflings-regular.woff",
+	"fonts/glyphicons-halflings-regular.woff2": "https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/fonts/glyphicons-halflings-regular.woff2",
+}
+
+type asset struct {
+	body string
+	etag string
+}
+
+var (
+	assets  = map[string]*asset{}
+	started = time.Now()
+)
+
+func register(name, body string) {
+	hash := sha256.Sum256([]byte(body))
+	assets[name] = &asset{
+		body: body,
+		etag: `"` + hex.EncodeToString(hash[:8]) + `"`}
+}
+
+// Missing returns the names of the Upstream assets that are neither
+// embedded nor in override_dir.
+func Missing(override_dir string) (names []string) {
+	for name := range Upstream {
+		if assets[name] == nil && !overridden(override_dir, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler serves the assets under the path it is given, which should have
+// the route's prefix stripped. files maps extra asset names to local files,
+// and files in override_dir, if set, take precedence over the embedded
+// assets, so they can be replaced without a rebuild. If cdn_fallback is
+// true, missing Upstream assets are redirected to their upstream URL.
+func Handler(override_dir string, files map[string]string,
+	cdn_fallback bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if upstream, exists := Upstream[name]; exists && cdn_fallback &&
+			assets[name] == nil && !overridden(override_dir, name) {
+			http.Redirect(w, r, upstream, http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age="+
+			strconv.FormatInt(int64(CacheMaxAge/time.Second), 10))
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+
+		if file, exists := files[name]; exists {
+			http.ServeFile(w, r, file)
+			return
+		}
+
+		if overridden(override_dir, name) {
+			http.ServeFile(w, r, filepath.Join(override_dir,
+				filepath.FromSlash(name)))
+			return
+		}
+
+		if a, exists := assets[name]; exists {
+			w.Header().Set("ETag", a.etag)
+			http.ServeContent(w, r, name, started, strings.NewReader(a.body))
+			return
+		}
+
+		w.Header().Del("Cache-Control")
+		http.NotFound(w, r)
+	})
+}
+
+func overridden(override_dir, name string) bool {
+	if override_dir == "" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(override_dir, filepath.FromSlash(name)))
+	return err == nil && !info.IsDir()
+}
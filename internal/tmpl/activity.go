@@ -0,0 +1,30 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("activity", `{{ template "header" . }}
+
+<h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
+
+<h2>Activity</h2>
+
+<table class="table table-striped">
+<tr><th>Time</th><th>User</th><th>Action</th><th>Object</th><th>Detail</th><th>From</th></tr>
+{{ range .Page.Events }}
+<tr>
+  <td>{{.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</td>
+  <td><code>{{.UserId}}</code>{{ if .APIKeyId }} (API key {{.APIKeyId}}){{ end }}</td>
+  <td>{{.Action}}</td>
+  <td>{{.ObjectType}} {{.ObjectId}}</td>
+  <td>{{.Detail}}</td>
+  <td title="{{.UserAgent}}">{{.RemoteAddr}}</td>
+</tr>
+{{ else }}
+<tr><td colspan="6">No activity yet.</td></tr>
+{{ end }}
+</table>
+
+{{ template "footer" . }}`)
+}
@@ -7,18 +7,86 @@ func init() {
 	register("apikeys", `{{ template "header" . }}
 
 <h1>API keys</h1>
-<ul>
+
+<table class="table table-striped">
+<tr>
+  <th>Name</th>
+  <th>Key</th>
+  <th>Created</th>
+  <th>Last used</th>
+  <th>Expires</th>
+  <th>Scope</th>
+  <th></th>
+</tr>
+{{ $now := .Page.Now }}
+{{ $names := .Page.ProjectNames }}
 {{ range .Page.Keys }}
-<li><code>{{.Key}}</code></li>
+<tr>
+  <td>{{.Name}}</td>
+  <td><code>{{.Prefix}}&hellip;</code></td>
+  <td>{{.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</td>
+  <td>{{ if .LastUsedAt }}{{.LastUsedAt.Format "Jan 02, 2006 15:04 MST"}}{{ else }}<i>never</i>{{ end }}</td>
+  <td>{{ if .ExpiresAt }}{{.ExpiresAt.Format "Jan 02, 2006"}}{{ if .Expired $now }} <span class="label label-danger">expired</span>{{ end }}{{ else }}<i>never</i>{{ end }}</td>
+  <td>
+    {{ if .ReadOnly }}read only{{ else }}read/write{{ end }},
+    {{ with .ProjectIds }}{{ range . }}<a href="/project/{{.}}">{{ or (index $names .) . }}</a> {{ end }}{{ else }}all projects{{ end }}
+  </td>
+  <td>
+    <form method="POST" action="/account/apikeys/{{.Id}}/revoke">
+    {{ template "csrf" $ }}
+      <button type="submit" class="btn btn-xs btn-danger">Revoke</button>
+    </form>
+  </td>
+</tr>
+{{ else }}
+<tr><td colspan="7">No API keys yet.</td></tr>
 {{ end }}
+</table>
+
+<h2>Create new</h2>
+<form method="POST">
+{{ template "csrf" $ }}
+<div class="row">
+<div class="col-md-6">
+  <input type="text" name="name" class="form-control" placeholder="Name"><br/>
+  <label for="expiresInput">Expires (optional)</label>
+  <input type="date" name="expires" class="form-control" id="expiresInput"
+      placeholder="YYYY-MM-DD"><br/>
+  <div class="radio">
+    <label><input type="radio" name="access" value="write" checked>
+      Read and write</label>
+  </div>
+  <div class="radio">
+    <label><input type="radio" name="access" value="read">
+      Read only</label>
+  </div>
+</div>
+<div class="col-md-6">
+  <label for="projectsInput">Limit to projects (none selected means all)</label>
+  <select name="project" class="form-control" id="projectsInput" multiple
+      size="6">
+  {{ range .Page.Projects }}
+    <option value="{{.Id}}">{{.Name}}</option>
+  {{ end }}
+  </select><br/>
+</div>
+</div>
+<button type="submit" class="btn btn-default">Create</button>
+</form>
+
+{{ template "footer" . }}`)
+
+	register("apikey", `{{ template "header" . }}
+
+<h1>API key created</h1>
+
+<p>Your new key <b>{{.Page.Name}}</b>{{ if .Page.ExpiresAt }}, expiring
+{{.Page.ExpiresAt.Format "Jan 02, 2006"}},{{ end }} is:</p>
+<pre>{{.Page.Key}}</pre>
+<div class="alert alert-warning">Copy it now. Only a hash of the key is
+stored, so it can't be shown again.</div>
 
-<br/>
-<li>
-  <form method="POST">
-    <button type="submit" class="btn btn-default">Create New</button>
-  </form>
-</li>
-</ul>
+<p><a href="/account/apikeys">Back to API keys</a></p>
 
 {{ template "footer" . }}`)
 }
@@ -0,0 +1,88 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("compare", `{{ template "header" . }}
+
+<h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
+<h2>Compare samples</h2>
+
+{{ $page := .Page }}
+<form method="GET" class="form-inline">
+  <select name="a" class="form-control">
+    {{ range .Page.Samples }}
+    <option value="{{.Id}}"{{ if (eq .Id $page.A) }} selected{{ end }}>{{.Name}}</option>
+    {{ end }}
+  </select>
+  vs
+  <select name="b" class="form-control">
+    {{ range .Page.Samples }}
+    <option value="{{.Id}}"{{ if (eq .Id $page.B) }} selected{{ end }}>{{.Name}}</option>
+    {{ end }}
+  </select>
+  <select name="topk-type" class="form-control">
+    <option value="rankdiff"{{ if (eq .Page.TopKType "rankdiff") }} selected{{ end }}>Rank difference</option>
+    <option value="valdiff"{{ if (eq .Page.TopKType "valdiff") }} selected{{ end }}>Value difference</option>
+  </select>
+  <input type="number" name="k" class="form-control" value="{{.Page.K}}" min="1">
+  <button type="submit" class="btn btn-default">Compare</button>
+</form>
+
+{{ with .Page.Comparison }}
+{{ $lookup := $page.Lookup }}
+<h3><a href="/project/{{$page.Project.Id}}/sample/{{$page.SampleA.Id}}">{{$page.SampleA.Name}}</a>
+  vs <a href="/project/{{$page.Project.Id}}/sample/{{$page.SampleB.Id}}">{{$page.SampleB.Name}}</a></h3>
+
+<dl class="dl-horizontal">
+  <dt>Shared dimensions</dt><dd>{{.Shared}}</dd>
+  <dt>Pearson</dt><dd>{{printf "%.4f" .Pearson}}</dd>
+  <dt>Spearman</dt><dd>{{printf "%.4f" .Spearman}}</dd>
+  <dt>Cosine</dt><dd>{{printf "%.4f" .Cosine}}</dd>
+  <dt>Top-{{$page.K}} overlap</dt><dd>{{printf "%.4f" .Overlap}}</dd>
+</dl>
+
+<div class="row">
+<div class="col-md-4">
+  <h4>Shared up-regulated</h4>
+  <ul>{{ range .SharedUp }}<li>{{($lookup.LookupName .)}}</li>{{ else }}<li><i>none</i></li>{{ end }}</ul>
+</div>
+<div class="col-md-4">
+  <h4>Shared down-regulated</h4>
+  <ul>{{ range .SharedDown }}<li>{{($lookup.LookupName .)}}</li>{{ else }}<li><i>none</i></li>{{ end }}</ul>
+</div>
+<div class="col-md-4">
+  <h4>Opposite directions</h4>
+  <ul>{{ range .Opposite }}<li>{{($lookup.LookupName .)}}</li>{{ else }}<li><i>none</i></li>{{ end }}</ul>
+</div>
+</div>
+
+<div class="row">
+<div class="col-md-6">
+<h4>Concordant dimensions</h4>
+<table class="table table-striped">
+<tr><th>Dimension</th><th>{{$page.SampleA.Name}}</th><th>{{$page.SampleB.Name}}</th></tr>
+{{ range .Concordant }}
+<tr><td>{{($lookup.LookupName .DimensionId)}}</td><td>{{.A}}</td><td>{{.B}}</td></tr>
+{{ else }}
+<tr><td colspan="3"><i>none</i></td></tr>
+{{ end }}
+</table>
+</div>
+<div class="col-md-6">
+<h4>Discordant dimensions</h4>
+<table class="table table-striped">
+<tr><th>Dimension</th><th>{{$page.SampleA.Name}}</th><th>{{$page.SampleB.Name}}</th></tr>
+{{ range .Discordant }}
+<tr><td>{{($lookup.LookupName .DimensionId)}}</td><td>{{.A}}</td><td>{{.B}}</td></tr>
+{{ else }}
+<tr><td colspan="3"><i>none</i></td></tr>
+{{ end }}
+</table>
+</div>
+</div>
+{{ end }}
+
+{{ template "footer" . }}`)
+}
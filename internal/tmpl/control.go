@@ -8,7 +8,56 @@ func init() {
 
 <h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
 <h2>Control: {{.Page.Control.Name}}</h2>
-<p>Created at <i>{{.Page.Control.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i></p>
+<p>Created at <i>{{.Page.Control.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i>
+{{ if gt .Page.Control.Replicates 1 }}
+  &middot; {{.Page.Control.Aggregate}} of {{.Page.Control.Replicates}} replicates
+{{ end }}</p>
+
+{{ with .Page.Control }}
+{{ if eq .RecomputeStatus "running" }}
+<p id="recompute-status">Recomputing samples: {{.RecomputeDone}} of {{.RecomputeTotal}} done</p>
+<div class="progress">
+  <div id="recompute-progress" class="progress-bar" role="progressbar"
+      style="width: 0%;"></div>
+</div>
+<script>
+(function() {
+  var url = "/project/{{$.Page.Project.Id}}/control/{{.Id}}/recompute";
+  function poll() {
+    var req = new XMLHttpRequest();
+    req.onload = function() {
+      if (req.status != 200) { return; }
+      var job = JSON.parse(req.responseText);
+      if (job.status != "running") {
+        window.location.reload();
+        return;
+      }
+      document.getElementById("recompute-status").textContent =
+        "Recomputing samples: " + job.done + " of " + job.total + " done";
+      if (job.total > 0) {
+        document.getElementById("recompute-progress").style.width =
+          (100 * job.done / job.total) + "%";
+      }
+      setTimeout(poll, 1000);
+    };
+    req.open("GET", url);
+    req.send();
+  }
+  poll();
+})();
+</script>
+{{ else if or (eq .RecomputeStatus "failed") (eq .RecomputeStatus "canceled") }}
+<div class="alert alert-danger">Recomputing samples {{.RecomputeStatus}} after
+{{.RecomputeDone}} of {{.RecomputeTotal}}{{ if .RecomputeError }}: {{.RecomputeError}}{{ end }}
+{{ if not $.Page.ReadOnly }}
+<form method="POST" action="/project/{{$.Page.Project.Id}}/control/{{.Id}}/recompute" style="display: inline">
+{{ template "csrf" $ }}
+  <button type="submit" class="btn btn-default btn-xs">Try again</button>
+</form>
+{{ end }}
+</div>
+{{ end }}
+{{ end }}
 
 <ul class="nav nav-tabs" role="tablist">
   <li role="presentation" class="active">
@@ -19,6 +68,10 @@ func init() {
     <a href="#newsample" aria-controls="newsample" role="tab"
       data-toggle="tab">Upload new sample</a>
   </li>
+  <li role="presentation">
+    <a href="#replace" aria-controls="replace" role="tab"
+      data-toggle="tab">Replace values</a>
+  </li>
 {{ end }}
 </ul>
 
@@ -28,27 +81,93 @@ func init() {
 <div class="tab-content">
   <div role="tabpanel" id="ranks" class="tab-pane fade in active">
 
+{{ $plot := (printf "/project/%d/control/%d/plot" .Page.Project.Id .Page.Control.Id) }}
+<div class="row">
+  <div class="col-md-12"><img src="{{$plot}}?type=waterfall" alt="Values by rank"></div>
+  <div class="col-md-12"><img src="{{$plot}}?type=histogram" alt="Values"></div>
+</div>
+
+{{ $pager := .Page.Pager }}
+{{ template "filter" $pager }}
 <table class="table table-striped">
-<tr><th>Dimension</th><th>Value</th><th>Rank</th></tr>
+<tr>
+  <th>Dimension</th>
+  <th><a href="{{$pager.SortURL "value"}}">Value</a> {{$pager.SortMark "value"}}</th>
+  {{ if gt $.Page.Control.Replicates 1 }}<th><a href="{{$pager.SortURL "std_dev"}}">Standard deviation</a> {{$pager.SortMark "std_dev"}}</th>{{ end }}
+  <th><a href="{{$pager.SortURL "rank"}}">Rank</a> {{$pager.SortMark "rank"}}</th>
+</tr>
 {{ $lookup := .Page.Lookup }}
 {{ range .Page.Values }}
 <tr>
   <td>{{($lookup.LookupName .DimensionId)}}</td>
   <td>{{.Value}}</td>
+  {{ if gt $.Page.Control.Replicates 1 }}<td>{{.StdDev}}</td>{{ end }}
   <td>{{.Rank}}</td>
 </tr>
+{{ else }}
+<tr><td colspan="{{ if gt $.Page.Control.Replicates 1 }}4{{ else }}3{{ end }}"><i>No matching dimensions.</i></td></tr>
 {{ end }}
 </table>
+{{ template "pager" $pager }}
 
   </div>
 {{ if not .Page.ReadOnly }}
   <div role="tabpanel" id="newsample" class="tab-pane fade">
 
-<form method="POST" action="/project/{{.Page.Project.Id}}/control/{{.Page.Control.Id}}/sample">
+<form method="POST" action="/project/{{.Page.Project.Id}}/control/{{.Page.Control.Id}}/sample"
+    enctype="multipart/form-data">
+{{ template "csrf" $ }}
 <input type="text" name="name" class="form-control" placeholder="Name"><br/>
+<div class="form-group">
+  <label>Normalization</label>
+  <select name="normalization" class="form-control">
+  {{ range .Page.Normalizations }}
+    <option value="{{.}}">{{.Description}}</option>
+  {{ end }}
+  </select>
+</div>
+{{ if gt .Page.Control.Replicates 1 }}
+<div class="form-group">
+  <label>Differences</label>
+  <select name="diff-type" class="form-control">
+  {{ range .Page.DiffTypes }}
+    <option value="{{.}}">{{.Description}}</option>
+  {{ end }}
+  </select>
+</div>
+{{ end }}
+<div class="form-group">
+  <label>Reference controls (robust z-score only)</label>
+  {{ range .Page.Controls }}
+  <div class="checkbox"><label>
+    <input type="checkbox" name="norm-controls" value="{{.Id}}"> {{.Name}}
+  </label></div>
+  {{ end }}
+</div>
 <textarea name="values" class="form-control" rows="5"
     placeholder="<dimension> <value> (one dimension per line)"></textarea><br/>
+<p>or upload a file:</p>
+<input type="file" name="values"><br/>
 <button type="submit" class="btn btn-default">Upload</button>
+</form>
+
+  </div>
+  <div role="tabpanel" id="replace" class="tab-pane fade">
+
+<p>Replacing the control's values recomputes all of its samples against
+them, along with any samples robust z-scored against this control.</p>
+<form method="POST" action="/project/{{.Page.Project.Id}}/control/{{.Page.Control.Id}}/values"
+    enctype="multipart/form-data">
+{{ template "csrf" $ }}
+<select name="aggregate" class="form-control">
+  <option value="mean">Mean of replicates</option>
+  <option value="median">Median of replicates</option>
+</select><br/>
+<textarea name="values" class="form-control" rows="5"
+    placeholder="<dimension> <value> [<value>...] (one dimension per line, one column per replicate)"></textarea><br/>
+<p>or upload a file:</p>
+<input type="file" name="values"><br/>
+<button type="submit" class="btn btn-default">Replace</button>
 </form>
 
   </div>
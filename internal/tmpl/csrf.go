@@ -0,0 +1,8 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("csrf", `<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">`)
+}
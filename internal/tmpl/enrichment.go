@@ -0,0 +1,38 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("enrichment", `{{ template "header" . }}
+
+<h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
+<h2>Sample: <a href="/project/{{.Page.Project.Id}}/sample/{{.Page.Sample.Id}}">{{.Page.Sample.Name}}</a></h2>
+<p>Weighted enrichment score <strong>{{.Page.Enrichment.Score}}</strong>
+  (weight p = {{.Page.Weight}})</p>
+
+{{ $lookup := .Page.Lookup }}
+{{ template "enrichmentset" (makepair "Up-regulated" (makepair .Page.Enrichment.Up $lookup)) }}
+{{ template "enrichmentset" (makepair "Down-regulated" (makepair .Page.Enrichment.Down $lookup)) }}
+
+{{ template "footer" . }}`)
+
+	register("enrichmentset", `{{ $set := .Second.First }}{{ $lookup := .Second.Second }}
+{{ if $set }}
+<div class="panel panel-default">
+  <div class="panel-heading">{{.First}} set: enrichment score {{$set.Score}}</div>
+  <div class="panel-body">
+    <svg width="800" height="200" viewBox="0 0 800 200"
+        style="max-width: 100%; border: 1px solid #ddd;">
+      <line x1="0" y1="100" x2="800" y2="100" stroke="#999"
+          stroke-dasharray="4,4" />
+      <polyline fill="none" stroke="#158cba" stroke-width="1.5"
+          points="{{$set.CurvePoints 800 200}}" />
+    </svg>
+    <p>Running sum across dimensions ordered by decreasing value difference.</p>
+    <h4>Leading edge ({{len $set.LeadingEdge}} dimensions)</h4>
+    <p>{{ range $set.LeadingEdge }}<code>{{($lookup.LookupName .)}}</code> {{ end }}</p>
+  </div>
+</div>
+{{ end }}`)
+}
@@ -11,19 +11,14 @@ func init() {
     <meta http-equiv="X-UA-Compatible" content="IE=edge">
     <meta name="viewport" content="width=device-width, initial-scale=1">
 
-    <title>JT's Connectivity Workbench!</title>
+    <title>{{.Brand}}</title>
 
-    <link rel="stylesheet"
-      href="https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/lumen/bootstrap.css">
-    <link rel="stylesheet"
-      href="https://cdnjs.cloudflare.com/ajax/libs/bootswatch/3.3.6/lumen/bootstrap.min.css">
-
-    <style>
-      body { padding-top: 70px; }
-    </style>
+    <link rel="stylesheet" href="/static/css/bootstrap.min.css">
+    <link rel="stylesheet" href="/static/css/cwbench.css">
+    {{ if .CustomCSS }}<link rel="stylesheet" href="/static/css/custom.css">{{ end }}
     <!--[if lt IE 9]>
-      <script src="https://oss.maxcdn.com/html5shiv/3.7.2/html5shiv.min.js"></script>
-      <script src="https://oss.maxcdn.com/respond/1.4.2/respond.min.js"></script>
+      <script src="/static/js/html5shiv.min.js"></script>
+      <script src="/static/js/respond.min.js"></script>
     <![endif]-->
   </head>
   <body>
@@ -38,13 +33,14 @@ func init() {
             <span class="icon-bar"></span>
             <span class="icon-bar"></span>
           </button>
-          <a class="navbar-brand" href="/">JT's Connectivity Workbench!</a>
+          <a class="navbar-brand" href="/">{{.Brand}}</a>
         </div>
         <div id="navbar" class="navbar-collapse collapse">
           <ul class="nav navbar-nav navbar-left">
-            <li><a href="/">Your projects</a></li>
+            <li><a href="/">{{ if .User }}Your projects{{ else }}Public projects{{ end }}</a></li>
           </ul>
           <ul class="nav navbar-nav navbar-right">
+            {{ if .User }}
             <li class="dropdown">
               <a href="#" class="dropdown-toggle" data-toggle="dropdown">
                 <img src="{{.User.Picture}}"
@@ -57,6 +53,9 @@ func init() {
                 <li><a href="{{.LogoutURL}}">Log Out</a></li>
               </ul>
             </li>
+            {{ else }}
+            <li><a href="{{.LoginURL}}">Log in</a></li>
+            {{ end }}
           </ul>
         </div>
       </div>
@@ -0,0 +1,26 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("pager", `{{ if or .HasPrev .HasNext }}
+<nav>
+  <ul class="pager">
+    {{ if .HasPrev }}<li class="previous"><a href="{{.PrevURL}}">&larr; Previous</a></li>{{ end }}
+    <li>{{.First}}&ndash;{{.End}} of {{.Total}}</li>
+    {{ if .HasNext }}<li class="next"><a href="{{.NextURL}}">Next &rarr;</a></li>{{ end }}
+  </ul>
+</nav>
+{{ end }}`)
+
+	register("filter", `<form method="GET" class="form-inline" style="text-align:right;">
+  {{ if .Sort }}
+  <input type="hidden" name="sort" value="{{.Sort}}">
+  <input type="hidden" name="order" value="{{ if .Desc }}desc{{ else }}asc{{ end }}">
+  {{ end }}
+  <input type="text" name="filter" class="form-control" value="{{.Filter}}"
+      placeholder="Dimension name">
+  <button type="submit" class="btn btn-default">Filter</button>
+</form>`)
+}
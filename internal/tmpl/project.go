@@ -9,8 +9,26 @@ func init() {
 <h1>Project: {{.Page.Project.Name}}</h1>
 <p>Created at <i>{{.Page.Project.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i></p>
 <p>Project is associated with {{ .Page.DimensionCount }} dimensions.</p>
+{{ if not .Page.ReadOnly }}
+<form method="POST" action="/project/{{.Page.Project.Id}}/dimensions">
+{{ template "csrf" $ }}
+<div class="row">
+<div class="col-md-10">
+  <textarea name="dimensions" class="form-control" rows="2"
+      placeholder="Additional dimensions (whitespace-separated)"></textarea>
+  <p class="help-block">Existing controls and samples will be marked partial.
+  Upload a new control to cover the added dimensions.</p>
+</div>
+<div class="col-md-2">
+  <button type="submit" class="btn btn-default">Add dimensions</button>
+</div>
+</div>
+</form>
+{{ end }}
 
 <h2>Search</h2>
+{{ if .User }}<p><a href="/project/{{.Page.Project.Id}}/search">Recent searches</a>{{ if (eq .User.Id .Page.Project.UserId) }}
+  &middot; <a href="/project/{{.Page.Project.Id}}/activity">Activity</a>{{ end }}</p>{{ end }}
 
 <ul class="nav nav-tabs" role="tablist">
   <li role="presentation" class="active">
@@ -20,6 +38,13 @@ func init() {
     <a href="#kolmogorov" aria-controls="kolmogorov" role="tab"
       data-toggle="tab">Kolmogorov-Smirnov</a>
   </li>
+  <li role="presentation">
+    <a href="#gsea" aria-controls="gsea" role="tab"
+      data-toggle="tab">Weighted enrichment</a>
+  </li>
+  <li role="presentation">
+    <a href="#xsum" aria-controls="xsum" role="tab" data-toggle="tab">XSum</a>
+  </li>
   <li role="presentation">
     <a href="#kbarcoding" aria-controls="kbarcoding" role="tab"
       data-toggle="tab">k-Barcoding</a>
@@ -33,6 +58,7 @@ func init() {
   <div role="tabpanel" id="topk" class="tab-pane fade in active">
 
 <form method="POST" action="/project/{{.Page.Project.Id}}/search">
+{{ template "csrf" $ }}
 <div class="row">
 <div class="col-md-6">
   <textarea name="up-regulated" class="form-control" rows="3"
@@ -78,6 +104,7 @@ func init() {
 
 <!--
 <form method="POST" action="/project/{{.Page.Project.Id}}/search">
+{{ template "csrf" $ }}
 <div class="row">
 <div class="col-md-6">
   <textarea name="up-regulated" class="form-control" rows="3"
@@ -100,6 +127,76 @@ func init() {
 -->
 Not yet implemented
 
+  </div>
+  <div role="tabpanel" id="gsea" class="tab-pane fade">
+
+<form method="POST" action="/project/{{.Page.Project.Id}}/search">
+{{ template "csrf" $ }}
+<div class="row">
+<div class="col-md-6">
+  <textarea name="up-regulated" class="form-control" rows="3"
+      placeholder="up-regulated dimensions (whitespace separated)"></textarea>
+  <br/>
+</div>
+<div class="col-md-6">
+  <textarea name="down-regulated" class="form-control" rows="3"
+      placeholder="down-regulated dimensions (whitespace separated)"></textarea>
+  <br/>
+</div>
+</div>
+<div class="row">
+<div class="col-md-12 form-inline" style="text-align:right;">
+  <div class="form-group">
+    <label for="weightInput"><strong>weight p = </strong></label>
+    <input type="number" name="weight" class="form-control" id="weightInput"
+      min="0" step="any" value="1" />
+  </div>
+  <input type="hidden" name="search-type" value="gsea" />
+  <button type="submit" class="btn btn-default">Search</button>
+</div>
+</div>
+</form>
+
+  </div>
+  <div role="tabpanel" id="xsum" class="tab-pane fade">
+
+<form method="POST" action="/project/{{.Page.Project.Id}}/search">
+{{ template "csrf" $ }}
+<div class="row">
+<div class="col-md-12">
+  <textarea name="signature" class="form-control" rows="5"
+      placeholder="<dimension> <value> (one dimension per line)"></textarea>
+  <br/>
+</div>
+</div>
+<div class="row">
+<div class="col-md-12 form-inline" style="text-align:right;">
+  <div style="display:inline-block; text-align:left; padding-right:20px;">
+  <div class="radio">
+    <label>
+      <input type="radio" name="topk-type" value="rankdiff" checked>
+      Sample top-N by rank difference
+    </label>
+  </div><br/>
+  <div class="radio">
+    <label>
+      <input type="radio" name="topk-type" value="valdiff">
+      Sample top-N by value difference
+    </label>
+  </div>
+  </div>
+
+  <div class="form-group">
+    <label for="xsumInput"><strong>N = </strong></label>
+    <input type="number" name="k" class="form-control" id="xsumInput"
+      value="100" />
+  </div>
+  <input type="hidden" name="search-type" value="xsum" />
+  <button type="submit" class="btn btn-default">Search</button>
+</div>
+</div>
+</form>
+
   </div>
   <div role="tabpanel" id="kbarcoding" class="tab-pane fade">
   Not yet implemented
@@ -118,16 +215,24 @@ Not yet implemented
 <ul>
 {{ $page := .Page }}
 {{ range .Page.Controls }}
-<li><a href="/project/{{$page.Project.Id}}/control/{{.Id}}">{{.Name}}</a></li>
+<li><a href="/project/{{$page.Project.Id}}/control/{{.Id}}">{{.Name}}</a>{{ if .Partial $page.DimensionCount }} (partial){{ end }}</li>
 {{ end }}
 
 {{ if not .Page.ReadOnly }}
 <br/>
 <li>Create new:<br/>
-  <form method="POST" action="/project/{{.Page.Project.Id}}/control">
+  <form method="POST" action="/project/{{.Page.Project.Id}}/control"
+      enctype="multipart/form-data">
+  {{ template "csrf" $ }}
   <input type="text" name="name" class="form-control" placeholder="Name"><br/>
+  <select name="aggregate" class="form-control">
+    <option value="mean">Mean of replicates</option>
+    <option value="median">Median of replicates</option>
+  </select><br/>
   <textarea name="values" class="form-control" rows="5"
-      placeholder="<dimension> <value> (one dimension per line)"></textarea><br/>
+      placeholder="<dimension> <value> [<value>...] (one dimension per line, one column per replicate)"></textarea><br/>
+  <p>or upload a file:</p>
+  <input type="file" name="values"><br/>
   <button type="submit" class="btn btn-default">Upload</button>
   </form>
 </li>
@@ -142,7 +247,7 @@ Not yet implemented
 <ul>
 {{ $page := .Page }}
 {{ range .Page.Samples }}
-<li><a href="/project/{{$page.Project.Id}}/sample/{{.Id}}">{{.Name}}</a></li>
+<li><a href="/project/{{$page.Project.Id}}/sample/{{.Id}}">{{.Name}}</a>{{ if .Partial $page.DimensionCount }} (partial){{ end }}</li>
 {{ end }}
 </ul>
 
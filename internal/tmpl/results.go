@@ -9,16 +9,48 @@ func init() {
 <h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
 
 <h2>Search results</h2>
+{{ $page := .Page }}
+{{ with .Page.Job }}
+<p>Submitted at <i>{{.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i>.
+{{ if eq .Status "done" }}{{.Scored}} samples scored.{{ end }}</p>
+
+<dl class="dl-horizontal">
+  <dt>Search type</dt><dd>{{.SearchType}}</dd>
+  {{ with $page.Sample }}<dt>Like sample</dt><dd><a href="/project/{{$page.Project.Id}}/sample/{{.Id}}">{{.Name}}</a></dd>{{ end }}
+  {{ if .Param "topk-type" }}<dt>Scored on</dt><dd>{{.Param "topk-type"}}</dd>{{ end }}
+  {{ if .Param "k" }}<dt>k</dt><dd>{{.Param "k"}}</dd>{{ end }}
+  {{ if .Param "weight" }}<dt>Weight</dt><dd>{{.Param "weight"}}</dd>{{ end }}
+  {{ if .Param "up-regulated" }}<dt>Up-regulated</dt><dd><code>{{.Param "up-regulated"}}</code></dd>{{ end }}
+  {{ if .Param "down-regulated" }}<dt>Down-regulated</dt><dd><code>{{.Param "down-regulated"}}</code></dd>{{ end }}
+  {{ if .Param "signature" }}<dt>Signature</dt><dd><pre>{{.Param "signature"}}</pre></dd>{{ end }}
+</dl>
+
+{{ if .Stale }}
+<div class="alert alert-warning">The project's samples have changed since
+this search ran, so these results may be out of date.</div>
+{{ end }}
+<form method="POST" action="/project/{{$page.Project.Id}}/search/{{.Id}}/rerun">
+{{ template "csrf" $ }}
+  <button type="submit" class="btn btn-default">Run again</button>
+  <a href="/project/{{$page.Project.Id}}/search">Recent searches</a>
+</form>
+{{ if eq .Status "canceled" }}
+<div class="alert alert-warning">This search was canceled after scoring {{.Scored}} of {{.Total}} samples.</div>
+{{ else if eq .Status "failed" }}
+<div class="alert alert-danger">This search failed: {{.Error}}</div>
+{{ end }}
+{{ end }}
 
 <table class="table table-striped">
 <tr><th>Sample</th><th>Score</th></tr>
-{{ $page := .Page }}
 {{ range .Page.Results }}
 <tr><td>
   <a href="/project/{{$page.Project.Id}}/sample/{{.Id}}">{{.Name}}</a>
-</td><td>{{.Score}}</td></tr>
+</td><td>{{.Score}}{{ if $page.DetailParams }}
+  (<a href="/project/{{$page.Project.Id}}/sample/{{.Id}}/enrichment?{{safeURL $page.DetailParams}}">details</a>){{ end }}</td></tr>
 {{ end }}
 </table>
+{{ template "pager" .Page.Pager }}
 
 {{ template "footer" . }}`)
 }
@@ -8,7 +8,23 @@ func init() {
 
 <h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
 <h2>Sample: {{.Page.Sample.Name}}</h2>
-<p>Created at <i>{{.Page.Sample.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i></p>
+<p>Created at <i>{{.Page.Sample.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i>
+  &middot; Normalization: {{.Page.Normalization.Description}}
+  &middot; Differences: {{.Page.DiffType.Description}}
+  &middot; <a href="/project/{{.Page.Project.Id}}/compare?a={{.Page.Sample.Id}}">Compare with another sample</a></p>
+{{ if not .Page.ReadOnly }}
+<form method="POST" action="/project/{{.Page.Project.Id}}/sample/{{.Page.Sample.Id}}/move"
+    class="form-inline">
+{{ template "csrf" $ }}
+  <label>Control</label>
+  <select name="control" class="form-control">
+  {{ range .Page.Controls }}
+    <option value="{{.Id}}"{{ if eq .Id $.Page.Sample.ControlId }} selected{{ end }}>{{.Name}}</option>
+  {{ end }}
+  </select>
+  <button type="submit" class="btn btn-default">Move</button>
+</form>
+{{ end }}
 
 <ul class="nav nav-tabs">
   <li role="presentation" class="active">
@@ -22,13 +38,25 @@ func init() {
 <div class="panel panel-default">
   <div class="panel-body">
 
+{{ $plot := (printf "/project/%d/sample/%d/plot" .Page.Project.Id .Page.Sample.Id) }}
+<div class="row">
+  <div class="col-md-12"><img src="{{$plot}}?type=scatter" alt="Value vs. control value"></div>
+  <div class="col-md-12"><img src="{{$plot}}?type=waterfall" alt="Rank differences"></div>
+  <div class="col-md-12"><img src="{{$plot}}?type=histogram" alt="Value differences"></div>
+</div>
+
+{{ $pager := .Page.Pager }}
+{{ template "filter" $pager }}
 <table class="table table-striped">
 <tr>
   <th>Dimension</th>
-  <th>Rank</th>
-  <th>Rank difference</th>
-  <th>Value</th>
-  <th>Value difference</th>
+  <th><a href="{{$pager.SortURL "rank"}}">Rank</a> {{$pager.SortMark "rank"}}</th>
+  <th><a href="{{$pager.SortURL "rank_diff"}}">Rank difference</a> {{$pager.SortMark "rank_diff"}}
+    (<a href="{{$pager.SortURL "abs_rank_diff"}}">abs</a> {{$pager.SortMark "abs_rank_diff"}})</th>
+  {{ if $.Page.Normalization }}<th><a href="{{$pager.SortURL "raw_value"}}">Raw value</a> {{$pager.SortMark "raw_value"}}</th>{{ end }}
+  <th><a href="{{$pager.SortURL "value"}}">Value</a> {{$pager.SortMark "value"}}</th>
+  <th><a href="{{$pager.SortURL "value_diff"}}">Value difference</a> {{$pager.SortMark "value_diff"}}
+    (<a href="{{$pager.SortURL "abs_value_diff"}}">abs</a> {{$pager.SortMark "abs_value_diff"}})</th>
 </tr>
 {{ $lookup := .Page.Lookup }}
 {{ range .Page.Values }}
@@ -36,11 +64,15 @@ func init() {
   <td>{{($lookup.LookupName .DimensionId)}}</td>
   <td>{{.Rank}}</td>
   <td>{{.RankDiff}}</td>
+  {{ if $.Page.Normalization }}<td>{{.RawValue}}</td>{{ end }}
   <td>{{.Value}}</td>
   <td>{{.ValueDiff}}</td>
 </tr>
+{{ else }}
+<tr><td colspan="{{ if $.Page.Normalization }}6{{ else }}5{{ end }}"><i>No matching dimensions.</i></td></tr>
 {{ end }}
 </table>
+{{ template "pager" $pager }}
 
   </div>
 </div>
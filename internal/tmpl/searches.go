@@ -0,0 +1,29 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("searches", `{{ template "header" . }}
+
+<h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
+
+<h2>Recent searches</h2>
+
+<table class="table table-striped">
+<tr><th>Submitted</th><th>Search type</th><th>Status</th><th></th></tr>
+{{ $page := .Page }}
+{{ range .Page.Jobs }}
+<tr>
+  <td><a href="/project/{{$page.Project.Id}}/search/{{.Id}}">{{.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</a></td>
+  <td>{{.SearchType}}</td>
+  <td>{{.Status}}</td>
+  <td>{{ if .Stale }}<span class="label label-warning">stale</span>{{ end }}</td>
+</tr>
+{{ else }}
+<tr><td colspan="4">No searches yet.</td></tr>
+{{ end }}
+</table>
+
+{{ template "footer" . }}`)
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package tmpl
+
+func init() {
+	register("searchjob", `{{ template "header" . }}
+
+<h1>Project: <a href="/project/{{.Page.Project.Id}}">{{.Page.Project.Name}}</a></h1>
+
+<h2>Search in progress</h2>
+<p>Submitted at <i>{{.Page.Job.CreatedAt.Format "Jan 02, 2006 15:04 MST"}}</i></p>
+
+<p id="job-status">
+{{ if eq .Page.Status "queued" }}Waiting for other searches to finish...{{ else }}{{.Page.Scored}} of {{.Page.Total}} samples scored{{ end }}
+</p>
+<div class="progress">
+  <div id="job-progress" class="progress-bar" role="progressbar"
+      style="width: 0%;"></div>
+</div>
+
+{{ if .Page.CanCancel }}
+<form method="POST" action="/project/{{.Page.Project.Id}}/search/{{.Page.Job.Id}}/cancel">
+{{ template "csrf" $ }}
+  <button type="submit" class="btn btn-default">Cancel search</button>
+</form>
+{{ end }}
+
+<script>
+(function() {
+  var url = "/project/{{.Page.Project.Id}}/search/{{.Page.Job.Id}}/progress";
+  function poll() {
+    var req = new XMLHttpRequest();
+    req.onload = function() {
+      if (req.status != 200) { return; }
+      var job = JSON.parse(req.responseText);
+      if (job.status != "queued" && job.status != "running") {
+        window.location.reload();
+        return;
+      }
+      if (job.status == "running") {
+        document.getElementById("job-status").textContent =
+          job.scored + " of " + job.total + " samples scored";
+        if (job.total > 0) {
+          document.getElementById("job-progress").style.width =
+            (100 * job.scored / job.total) + "%";
+        }
+      }
+      setTimeout(poll, 1000);
+    };
+    req.open("GET", url);
+    req.send();
+  }
+  poll();
+})();
+</script>
+
+{{ template "footer" . }}`)
+}
@@ -22,15 +22,40 @@ func init() {
 <div class="panel panel-default">
   <div class="panel-body">
 
-  <table class="table table-striped">
-  <tr><th>Sample</th><th>Score</th></tr>
-  {{ $page := .Page }}
-  {{ range .Page.Results }}
-  <tr><td>
-    <a href="/project/{{$page.Project.Id}}/sample/{{.Id}}/similar?{{safeURL $page.Params}}">{{.Name}}</a>
-  </td><td>{{.Score}}</td></tr>
-  {{ end }}
-  </table>
+  <form method="POST" action="/project/{{.Page.Project.Id}}/sample/{{.Page.Sample.Id}}/similar"
+      class="form-inline" style="text-align:right;">
+  {{ template "csrf" $ }}
+  <div class="form-group">
+    <select name="search-type" class="form-control">
+      <option value="topk"{{ if eq .Page.SearchType "topk" }} selected{{ end }}>Top-k overlap</option>
+      <option value="spearman"{{ if eq .Page.SearchType "spearman" }} selected{{ end }}>Spearman correlation</option>
+      <option value="pearson"{{ if eq .Page.SearchType "pearson" }} selected{{ end }}>Pearson correlation</option>
+      <option value="cosine"{{ if eq .Page.SearchType "cosine" }} selected{{ end }}>Cosine similarity</option>
+      <option value="gsea"{{ if eq .Page.SearchType "gsea" }} selected{{ end }}>Weighted enrichment</option>
+      <option value="xsum"{{ if eq .Page.SearchType "xsum" }} selected{{ end }}>XSum</option>
+    </select>
+  </div>
+  <div class="form-group">
+    <select name="topk-type" class="form-control">
+      <option value="rankdiff"{{ if eq .Page.TopKType "rankdiff" }} selected{{ end }}>Rank difference</option>
+      <option value="valdiff"{{ if eq .Page.TopKType "valdiff" }} selected{{ end }}>Value difference</option>
+    </select>
+  </div>
+  <div class="form-group">
+    <label for="topkInput"><strong>k = </strong></label>
+    <input type="number" name="k" class="form-control" id="topkInput"
+      value="{{.Page.K}}" />
+  </div>
+  <div class="form-group">
+    <label for="weightInput"><strong>p = </strong></label>
+    <input type="number" name="weight" class="form-control" id="weightInput"
+      min="0" step="any" value="{{.Page.Weight}}" />
+  </div>
+  <button type="submit" class="btn btn-default">Search</button>
+  </form>
+
+  <p>Searches run in the background. Their results are kept with the
+  project's <a href="/project/{{.Page.Project.Id}}/search">recent searches</a>.</p>
 
   </div>
 </div>
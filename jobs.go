@@ -0,0 +1,426 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+)
+
+const (
+	SearchJobQueued   = "queued"
+	SearchJobRunning  = "running"
+	SearchJobDone     = "done"
+	SearchJobFailed   = "failed"
+	SearchJobCanceled = "canceled"
+
+	// searchResultBatch is how many results are inserted per statement, which
+	// keeps each statement's parameters within what every database allows.
+	searchResultBatch = 250
+)
+
+var (
+	searchJobLimit = flag.Int("search_jobs", 2,
+		"number of search jobs to run at once. further jobs are queued")
+	searchAbandonAfter = flag.Duration("search_abandon_after", 2*time.Minute,
+		"cancel search jobs whose status nobody has asked for in this long, "+
+			"such as when their progress page was closed. 0 never cancels them")
+
+	progressKey ctxKey = 2
+)
+
+// Progress counts scored samples. A nil *Progress ignores updates, so code
+// that reports progress doesn't need to know if anyone is listening.
+type Progress struct {
+	done, total int64
+}
+
+func (p *Progress) Start(total int) {
+	if p != nil {
+		atomic.StoreInt64(&p.total, int64(total))
+	}
+}
+
+func (p *Progress) Add(done int) {
+	if p != nil {
+		atomic.AddInt64(&p.done, int64(done))
+	}
+}
+
+func (p *Progress) Get() (done, total int) {
+	if p == nil {
+		return 0, 0
+	}
+	return int(atomic.LoadInt64(&p.done)), int(atomic.LoadInt64(&p.total))
+}
+
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey, p)
+}
+
+func ProgressFromContext(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey).(*Progress)
+	return p
+}
+
+func (d *Data) NewSearchJob(user_id string, project_id int64,
+	search_type string, params url.Values, detail_params string) (
+	*SearchJob, error) {
+	job := &SearchJob{
+		ProjectId:    project_id,
+		UserId:       user_id,
+		Status:       SearchJobQueued,
+		SearchType:   search_type,
+		Params:       params.Encode(),
+		DetailParams: detail_params}
+	return job, Err.Wrap(d.db.Create(job).Error)
+}
+
+func (d *Data) RecentSearchJobs(user_id string, project_id int64,
+	limit int) (jobs []SearchJob, err error) {
+	return jobs, Err.Wrap(d.db.Where("project_id = ? AND user_id = ?",
+		project_id, user_id).Order("created_at desc").Limit(limit).Find(
+		&jobs).Error)
+}
+
+// markSearchesStale flags every stored search of the project, as its set of
+// samples no longer matches what the searches scored.
+func markSearchesStale(tx *gorm.DB, project_id int64) error {
+	return Err.Wrap(tx.Model(SearchJob{}).Where("project_id = ?",
+		project_id).Update("stale", true).Error)
+}
+
+// FinishSearchJob stores the job's results and final status. If that fails,
+// the job is still marked as failed, so it doesn't look queued or running
+// until the next restart.
+func (d *Data) FinishSearchJob(job_id int64, status string, job_err error,
+	scored, total int, results SearchResults) error {
+	err := d.finishSearchJob(job_id, status, job_err, scored, total, results)
+	if err == nil {
+		return nil
+	}
+	ferr := d.db.Model(&SearchJob{Id: job_id}).Updates(
+		map[string]interface{}{
+			"status":      SearchJobFailed,
+			"error":       "storing results: " + err.Error(),
+			"finished_at": time.Now()}).Error
+	if ferr != nil {
+		return Err.New("%v (marking the job failed: %v)", err, ferr)
+	}
+	return err
+}
+
+func (d *Data) finishSearchJob(job_id int64, status string, job_err error,
+	scored, total int, results SearchResults) error {
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+
+	err := insertSearchResults(tx.DB, job_id, results)
+	if err != nil {
+		return err
+	}
+
+	msg := ""
+	if job_err != nil {
+		msg = job_err.Error()
+	}
+	err = tx.Model(&SearchJob{Id: job_id}).Updates(map[string]interface{}{
+		"status":      status,
+		"error":       msg,
+		"scored":      scored,
+		"total":       total,
+		"finished_at": time.Now()}).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// insertSearchResults inserts the results searchResultBatch rows at a time,
+// rather than one statement per row.
+func insertSearchResults(tx *gorm.DB, job_id int64,
+	results SearchResults) error {
+	for len(results) > 0 {
+		batch := results
+		if len(batch) > searchResultBatch {
+			batch = batch[:searchResultBatch]
+		}
+		results = results[len(batch):]
+
+		rows := make([]string, 0, len(batch))
+		args := make([]interface{}, 0, 3*len(batch))
+		for _, result := range batch {
+			rows = append(rows, "(?, ?, ?)")
+			args = append(args, job_id, result.Id, result.Score)
+		}
+		err := tx.Exec(`INSERT INTO search_job_results
+		  (search_job_id, sample_id, score) VALUES `+
+			strings.Join(rows, ", ")+`;`, args...).Error
+		if err != nil {
+			return Err.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// FailInterruptedSearchJobs marks jobs that were still running when the
+// server last stopped as failed.
+func (d *Data) FailInterruptedSearchJobs() error {
+	return Err.Wrap(d.db.Model(SearchJob{}).Where("status IN (?)",
+		[]string{SearchJobQueued, SearchJobRunning}).Updates(
+		map[string]interface{}{
+			"status":      SearchJobFailed,
+			"error":       "interrupted by server restart",
+			"finished_at": time.Now()}).Error)
+}
+
+func (d *Data) SearchJob(user *UserInfo, project_id, job_id int64) (
+	*Project, *SearchJob, error) {
+	var job SearchJob
+	err := d.db.Where("id = ?", job_id).First(&job).Error
+	if err != nil {
+		return nil, nil, ErrNotFound.Wrap(err)
+	}
+	if project_id != job.ProjectId {
+		return nil, nil, ErrNotFound.New("not found")
+	}
+	proj, _, err := d.Project(user, job.ProjectId)
+	return proj, &job, err
+}
+
+func (d *Data) SearchJobResults(job_id int64) (SearchResults, error) {
+	var rows []SearchJobResult
+	err := d.db.Where("search_job_id = ?", job_id).Find(&rows).Error
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.SampleId)
+	}
+	var samples []Sample
+	err = d.db.Where("id IN (?)", ids).Find(&samples).Error
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	lookup := make(map[int64]Sample, len(samples))
+	for _, sample := range samples {
+		lookup[sample.Id] = sample
+	}
+	results := make(SearchResults, 0, len(rows))
+	for _, row := range rows {
+		sample, exists := lookup[row.SampleId]
+		if !exists {
+			continue
+		}
+		results = append(results, SearchResult{Sample: sample, Score: row.Score})
+	}
+	sort.Sort(results)
+	return results, nil
+}
+
+type runningSearch struct {
+	progress Progress
+	started  int32
+	cancel   context.CancelFunc
+
+	// watched is when the job's status was last asked for, in unix
+	// nanoseconds, and abandoned is set if it was canceled for being unwatched
+	// too long.
+	watched   int64
+	abandoned int32
+}
+
+func (r *runningSearch) watch(now time.Time) {
+	atomic.StoreInt64(&r.watched, now.UnixNano())
+}
+
+// SearchJobs runs searches in the background, at most searchJobLimit at a
+// time, and keeps track of their progress until their results are stored.
+type SearchJobs struct {
+	data  *Data
+	slots chan struct{}
+
+	mtx     sync.Mutex
+	running map[int64]*runningSearch
+	wg      sync.WaitGroup
+}
+
+func NewSearchJobs(data *Data) *SearchJobs {
+	return &SearchJobs{
+		data:    data,
+		slots:   make(chan struct{}, *searchJobLimit),
+		running: map[int64]*runningSearch{}}
+}
+
+func (j *SearchJobs) Submit(user_id string, project_id int64,
+	search_type string, params url.Values, detail_params string,
+	run func(ctx context.Context) (SearchResults, error)) (
+	job_id int64, err error) {
+	job, err := j.data.NewSearchJob(user_id, project_id, search_type, params,
+		detail_params)
+	if err != nil {
+		return 0, err
+	}
+
+	// jobs outlive the request that submits them, which is redirected to the
+	// job's progress page. The job is tied to that page instead: it's canceled
+	// once the page stops polling, see cancelAbandoned.
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningSearch{cancel: cancel}
+	r.watch(time.Now())
+	ctx = WithProgress(ctx, &r.progress)
+
+	j.mtx.Lock()
+	j.running[job.Id] = r
+	j.mtx.Unlock()
+
+	if *searchAbandonAfter > 0 {
+		go cancelAbandoned(ctx, r, *searchAbandonAfter)
+	}
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		defer cancel()
+		results, err := j.run(ctx, r, search_type, run)
+		if err != nil && atomic.LoadInt32(&r.abandoned) != 0 {
+			err = ErrCanceled.New("nobody was watching the search's progress")
+		}
+		status := SearchJobDone
+		if err != nil {
+			status = SearchJobFailed
+			if ErrCanceled.Contains(err) || ctx.Err() != nil {
+				status = SearchJobCanceled
+			}
+			results = nil
+		}
+		scored, total := r.progress.Get()
+		ferr := j.data.FinishSearchJob(job.Id, status, err, scored, total,
+			results)
+		if ferr != nil {
+			log.Printf("failed storing search job %d: %v", job.Id, ferr)
+		}
+		j.mtx.Lock()
+		delete(j.running, job.Id)
+		j.mtx.Unlock()
+	}()
+
+	return job.Id, nil
+}
+
+func (j *SearchJobs) run(ctx context.Context, r *runningSearch,
+	search_type string,
+	run func(ctx context.Context) (SearchResults, error)) (
+	SearchResults, error) {
+	select {
+	case j.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrCanceled.Wrap(ctx.Err())
+	}
+	defer func() { <-j.slots }()
+	atomic.StoreInt32(&r.started, 1)
+	started := time.Now()
+	defer func() {
+		scored, _ := r.progress.Get()
+		observeSearch(search_type, started, scored)
+	}()
+	return run(ctx)
+}
+
+// cancelAbandoned cancels the search once its status hasn't been asked for
+// in timeout, or returns when ctx is done.
+func cancelAbandoned(ctx context.Context, r *runningSearch,
+	timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&r.watched))) > timeout {
+				atomic.StoreInt32(&r.abandoned, 1)
+				r.cancel()
+				return
+			}
+		}
+	}
+}
+
+// Status returns the live status of a job that hasn't been stored yet. If
+// running is false, the job's stored SearchJob row is authoritative. Asking
+// keeps the job from being canceled as abandoned.
+func (j *SearchJobs) Status(job_id int64) (
+	status string, scored, total int, running bool) {
+	j.mtx.Lock()
+	r, running := j.running[job_id]
+	j.mtx.Unlock()
+	if !running {
+		return "", 0, 0, false
+	}
+	r.watch(time.Now())
+	status = SearchJobQueued
+	if atomic.LoadInt32(&r.started) != 0 {
+		status = SearchJobRunning
+	}
+	scored, total = r.progress.Get()
+	return status, scored, total, true
+}
+
+// Load returns how many searches are running and waiting to run, out of how
+// many may run at once.
+func (j *SearchJobs) Load() (busy, queued, slots int) {
+	busy = len(j.slots)
+	j.mtx.Lock()
+	queued = len(j.running) - busy
+	j.mtx.Unlock()
+	if queued < 0 {
+		queued = 0
+	}
+	return busy, queued, cap(j.slots)
+}
+
+// Stop cancels all running searches and waits until their status is stored
+// or ctx is done, whichever is first.
+func (j *SearchJobs) Stop(ctx context.Context) {
+	j.mtx.Lock()
+	for _, r := range j.running {
+		r.cancel()
+	}
+	j.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (j *SearchJobs) Cancel(job_id int64) {
+	j.mtx.Lock()
+	r, running := j.running[job_id]
+	j.mtx.Unlock()
+	if running {
+		r.cancel()
+	}
+}
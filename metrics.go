@@ -0,0 +1,248 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/webhelp.v1/whroute"
+)
+
+const metricsNamespace = "cwbench"
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent serving HTTP requests, by route.",
+	}, []string{"route", "method", "code"})
+	searchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_duration_seconds",
+		Help:      "Time spent running searches, by search type.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"search_type"})
+	searchScored = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_samples_scored",
+		Help:      "Number of samples scored per search, by search type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"search_type"})
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time spent in database queries, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"operation"})
+	uploadBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_bytes",
+		Help:      "Size of uploaded request bodies, by what was uploaded.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, searchDuration, searchScored,
+		dbQueryDuration, uploadBytes)
+}
+
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether the database is reachable.
+func (a *Endpoints) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	err := a.Data.Ping()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "database unavailable: %v\n", err)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// registerJobMetrics exports the utilization of the search worker pool.
+func registerJobMetrics(jobs *SearchJobs) {
+	gauge := func(name, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, value)
+	}
+	prometheus.MustRegister(
+		gauge("search_workers", "Number of searches that may run at once.",
+			func() float64 { _, _, slots := jobs.Load(); return float64(slots) }),
+		gauge("search_workers_busy", "Number of searches running.",
+			func() float64 { busy, _, _ := jobs.Load(); return float64(busy) }),
+		gauge("search_jobs_queued", "Number of searches waiting to run.",
+			func() float64 { _, queued, _ := jobs.Load(); return float64(queued) }))
+}
+
+func observeSearch(search_type string, started time.Time, scored int) {
+	searchDuration.WithLabelValues(search_type).Observe(
+		time.Since(started).Seconds())
+	searchScored.WithLabelValues(search_type).Observe(float64(scored))
+}
+
+func observeUpload(kind string, req *http.Request) {
+	if req.ContentLength >= 0 {
+		uploadBytes.WithLabelValues(kind).Observe(float64(req.ContentLength))
+	}
+}
+
+// instrumentDB times every query made through db.
+func instrumentDB(db *gorm.DB) {
+	start := func(scope *gorm.Scope) {
+		scope.InstanceSet("cwbench:started", time.Now())
+	}
+	finish := func(operation string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			started, ok := scope.InstanceGet("cwbench:started")
+			if !ok {
+				return
+			}
+			dbQueryDuration.WithLabelValues(operation).Observe(
+				time.Since(started.(time.Time)).Seconds())
+		}
+	}
+	callbacks := db.Callback()
+	for _, op := range []struct {
+		name      string
+		processor func() *gorm.CallbackProcessor
+	}{
+		{"create", callbacks.Create},
+		{"query", callbacks.Query},
+		{"update", callbacks.Update},
+		{"delete", callbacks.Delete},
+		{"row_query", callbacks.RowQuery},
+	} {
+		op.processor().Before("gorm:"+op.name).Register(
+			"cwbench:start_"+op.name, start)
+		op.processor().After("gorm:"+op.name).Register(
+			"cwbench:finish_"+op.name, finish(op.name))
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// instrumentRequests times requests by route. A request's route is the one
+// of h's routes, as whroute lists them, that its path matches, and requests
+// matching none are labeled "other", so that the labels are limited to the
+// routes the server has.
+func instrumentRequests(h http.Handler) http.Handler {
+	routes := listRoutes(h)
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			h.ServeHTTP(sw, r)
+			if sw.code == 0 {
+				sw.code = http.StatusOK
+			}
+			requestDuration.WithLabelValues(routes.label(r.URL.Path),
+				methodLabel(r.Method), strconv.Itoa(sw.code)).Observe(
+				time.Since(started).Seconds())
+		})
+}
+
+// methodLabel is the request's method, or "other" for methods the server
+// doesn't route on.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// routeList holds the paths of a handler's routes. Path segments in angle
+// brackets, such as <int>, are arguments, which match any segment.
+type routeList struct {
+	paths    []string
+	segments [][]string
+}
+
+func listRoutes(h http.Handler) *routeList {
+	l := &routeList{}
+	seen := map[string]bool{}
+	whroute.Routes(h, func(method, path string,
+		annotations map[string]string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		l.paths = append(l.paths, path)
+		l.segments = append(l.segments, pathSegments(path))
+	})
+	return l
+}
+
+// label returns the route path matches. If several do, the one with the
+// most literal segments wins, so /sample/new is preferred to /sample/<int>.
+func (l *routeList) label(path string) string {
+	if strings.HasPrefix(path, "/static/") {
+		return "/static/"
+	}
+	segments := pathSegments(path)
+	best, best_literals := "other", -1
+	for i, route := range l.segments {
+		literals, ok := matchRoute(route, segments)
+		if ok && literals > best_literals {
+			best, best_literals = l.paths[i], literals
+		}
+	}
+	return best
+}
+
+func matchRoute(route, segments []string) (literals int, ok bool) {
+	if len(route) != len(segments) {
+		return 0, false
+	}
+	for i, segment := range route {
+		if strings.HasPrefix(segment, "<") && strings.HasSuffix(segment, ">") {
+			continue
+		}
+		if segment != segments[i] {
+			return 0, false
+		}
+		literals++
+	}
+	return literals, true
+}
+
+func pathSegments(path string) (segments []string) {
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spacemonkeygo/errors"
+)
+
+// migration brings the schema of a database made by createdb in an older
+// version up to date. Migrations are run in order, every time, so each must
+// leave a database it already ran on unchanged.
+type migration struct {
+	name string
+	run  func(tx *gorm.DB, errs *errors.ErrorGroup)
+}
+
+var migrations = []migration{
+	{name: "dimension counts", run: func(tx *gorm.DB,
+		errs *errors.ErrorGroup) {
+		addColumn(tx, errs, "samples", "dimension_count", "integer", "0")
+		errs.Add(tx.Exec(`UPDATE samples SET dimension_count = (
+		    SELECT COUNT(*) FROM sample_values
+		    WHERE sample_values.sample_id = samples.id)
+		  WHERE dimension_count = 0;`).Error)
+		addColumn(tx, errs, "controls", "dimension_count", "integer", "0")
+		errs.Add(tx.Exec(`UPDATE controls SET dimension_count = (
+		    SELECT COUNT(*) FROM control_values
+		    WHERE control_values.control_id = controls.id)
+		  WHERE dimension_count = 0;`).Error)
+	}},
+	{name: "search jobs", run: createSearchJobTables},
+	{name: "api key hashes", run: migrateAPIKeys},
+	{name: "audit events", run: createAuditTables},
+	{name: "value indexes", run: func(tx *gorm.DB,
+		errs *errors.ErrorGroup) {
+		if tx.HasTable("sample_values") {
+			rowStore{}.createTables(tx, errs)
+		}
+		errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+		  idx_control_values_control_id_value ON
+		      control_values(control_id, value);`).Error)
+	}},
+	{name: "normalization", run: func(tx *gorm.DB,
+		errs *errors.ErrorGroup) {
+		addColumn(tx, errs, "samples", "normalization",
+			"character varying(16)", "''")
+		addColumn(tx, errs, "samples", "norm_controls", "text", "''")
+		if tx.HasTable("sample_values") {
+			// values uploaded before normalization are their own raw values,
+			// which recomputes start from.
+			errs.Add(tx.Exec(`ALTER TABLE sample_values
+			  ADD COLUMN IF NOT EXISTS raw_value real;`).Error)
+			errs.Add(tx.Exec(`UPDATE sample_values SET raw_value = value
+			  WHERE raw_value IS NULL;`).Error)
+			errs.Add(tx.Exec(`ALTER TABLE sample_values
+			  ALTER COLUMN raw_value SET NOT NULL;`).Error)
+		}
+	}},
+	{name: "replicates", run: func(tx *gorm.DB, errs *errors.ErrorGroup) {
+		addColumn(tx, errs, "samples", "diff_type", "character varying(16)",
+			"''")
+		addColumn(tx, errs, "controls", "replicates", "integer", "1")
+		addColumn(tx, errs, "controls", "aggregate", "character varying(16)",
+			"'mean'")
+		addColumn(tx, errs, "control_values", "std_dev", "real", "0")
+	}},
+	{name: "recomputes", run: func(tx *gorm.DB, errs *errors.ErrorGroup) {
+		addColumn(tx, errs, "controls", "recompute_status",
+			"character varying(16)", "''")
+		addColumn(tx, errs, "controls", "recompute_error", "text", "''")
+		addColumn(tx, errs, "controls", "recompute_done", "integer", "0")
+		addColumn(tx, errs, "controls", "recompute_total", "integer", "0")
+		errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+		  idx_samples_control_id ON samples(control_id);`).Error)
+	}},
+	{name: "sample storage", run: func(tx *gorm.DB,
+		errs *errors.ErrorGroup) {
+		createSettingsTables(tx, errs)
+		// databases made before the mode was recorded used sample_values,
+		// unless they were made with blobs.
+		mode := StorageRows
+		if !tx.HasTable("sample_values") && tx.HasTable("sample_vectors") {
+			mode = StorageBlobs
+		}
+		errs.Add(tx.Exec(`INSERT INTO settings (name, value)
+		  SELECT ?, ? WHERE NOT EXISTS (
+		    SELECT 1 FROM settings WHERE name = ?);`,
+			settingSampleStorage, mode, settingSampleStorage).Error)
+	}},
+}
+
+// addColumn adds a NOT NULL column to table, unless it already has it.
+// Existing rows get def, which is a SQL expression.
+func addColumn(tx *gorm.DB, errs *errors.ErrorGroup, table, column,
+	column_type, def string) {
+	errs.Add(tx.Exec(fmt.Sprintf(`ALTER TABLE %s
+	  ADD COLUMN IF NOT EXISTS %s %s NOT NULL DEFAULT %s;`,
+		table, column, column_type, def)).Error)
+}
+
+// MigrateDB updates the schema of a database created by an older version,
+// filling new columns in from existing data where they depend on it.
+func (d *Data) MigrateDB() error {
+	tx := d.db.Begin()
+	for _, m := range migrations {
+		var errs errors.ErrorGroup
+		m.run(tx, &errs)
+		err := errs.Finalize()
+		if err != nil {
+			tx.Rollback()
+			return Err.New("migrating %s: %v", m.name, err)
+		}
+	}
+	tx.Commit()
+	return nil
+}
+
+// migrateAPIKeys replaces the api_keys key column, which held the keys
+// themselves, with their hashes and prefixes, and adds the columns scoped
+// keys need.
+func migrateAPIKeys(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`CREATE SEQUENCE IF NOT EXISTS api_keys_id_seq;`).Error)
+	addColumn(tx, errs, "api_keys", "id", "bigint",
+		"nextval('api_keys_id_seq')")
+	addColumn(tx, errs, "api_keys", "name", "character varying(255)", "''")
+	addColumn(tx, errs, "api_keys", "hash", "character varying(64)", "''")
+	addColumn(tx, errs, "api_keys", "prefix", "character varying(16)", "''")
+	addColumn(tx, errs, "api_keys", "created_at", "timestamp with time zone",
+		"now()")
+	errs.Add(tx.Exec(`ALTER TABLE api_keys
+	  ADD COLUMN IF NOT EXISTS last_used_at timestamp with time zone;`).Error)
+	errs.Add(tx.Exec(`ALTER TABLE api_keys
+	  ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone;`).Error)
+	addColumn(tx, errs, "api_keys", "read_only", "boolean", "false")
+	addColumn(tx, errs, "api_keys", "projects", "text", "''")
+
+	if tx.Dialect().HasColumn("api_keys", "key") {
+		rows, err := tx.Raw(`SELECT id, key FROM api_keys
+		  WHERE hash = '';`).Rows()
+		if err != nil {
+			errs.Add(err)
+			return
+		}
+		keys := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var key string
+			err = rows.Scan(&id, &key)
+			if err != nil {
+				errs.Add(err)
+				break
+			}
+			keys[id] = key
+		}
+		errs.Add(rows.Err())
+		rows.Close()
+
+		for id, key := range keys {
+			prefix := key
+			if len(prefix) > apiKeyPrefixLen {
+				prefix = prefix[:apiKeyPrefixLen]
+			}
+			errs.Add(tx.Exec(`UPDATE api_keys SET hash = ?, prefix = ?
+			  WHERE id = ?;`, hashAPIKey(key), prefix, id).Error)
+		}
+		errs.Add(tx.Exec(`ALTER TABLE api_keys DROP COLUMN key;`).Error)
+	}
+	errs.Add(tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS
+	  idx_api_keys_hash ON api_keys(hash);`).Error)
+}
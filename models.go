@@ -4,16 +4,57 @@
 package main
 
 import (
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/spacemonkeygo/errors"
 )
 
 type APIKey struct {
-	UserId string
-	Key    string
+	Id         int64 `gorm:"primary_key"`
+	UserId     string
+	Name       string
+	Hash       string
+	Prefix     string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	ReadOnly   bool
+	// Projects is a comma-separated list of the project ids the key is
+	// limited to. If empty, the key can access all of the user's projects.
+	Projects string
 }
 
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func (k APIKey) ProjectIds() (ids []int64) {
+	for _, field := range strings.Split(k.Projects, ",") {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (k APIKey) Scoped() bool {
+	return k.ReadOnly || k.Projects != ""
+}
+
+// Setting is a property of the database itself, such as how it stores
+// samples.
+type Setting struct {
+	Name  string `gorm:"primary_key"`
+	Value string
+}
+
+const settingSampleStorage = "sample_storage"
+
 type Project struct {
 	Id        int64 `gorm:"primary_key"`
 	CreatedAt time.Time
@@ -29,11 +70,49 @@ type Dimension struct {
 }
 
 type Sample struct {
-	Id        int64 `gorm:"primary_key"`
-	ControlId int64
-	CreatedAt time.Time
-	ProjectId int64
-	Name      string
+	Id             int64 `gorm:"primary_key"`
+	ControlId      int64
+	CreatedAt      time.Time
+	ProjectId      int64
+	Name           string
+	DimensionCount int
+	// Normalization is how the sample's values were normalized before they
+	// were ranked. NormControls is a comma-separated list of the reference
+	// control ids, for normalizations that use them.
+	Normalization string
+	NormControls  string
+	// DiffType is what the sample's value differences measure.
+	DiffType string
+}
+
+func (s Sample) Partial(project_dimensions int) bool {
+	return s.DimensionCount < project_dimensions
+}
+
+func (s Sample) NormalizeOptions() NormalizeOptions {
+	opts := NormalizeOptions{Method: Normalization(s.Normalization)}
+	for _, field := range strings.Split(s.NormControls, ",") {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err == nil {
+			opts.Controls = append(opts.Controls, id)
+		}
+	}
+	return opts
+}
+
+// normalizedAgainst is whether the sample's normalization depends on the
+// values of the control, other than its own.
+func (s Sample) normalizedAgainst(control_id int64) bool {
+	opts := s.NormalizeOptions()
+	if opts.Method != NormRobustZ {
+		return false
+	}
+	for _, id := range opts.Controls {
+		if id == control_id {
+			return true
+		}
+	}
+	return false
 }
 
 type SampleValue struct {
@@ -44,38 +123,112 @@ type SampleValue struct {
 	RankDiff    int
 	AbsRankDiff int
 
+	// RawValue is the value as uploaded, and Value is RawValue normalized.
+	RawValue     float64
 	Value        float64
 	ValueDiff    float64
 	AbsValueDiff float64
 }
 
 type Control struct {
-	Id        int64 `gorm:"primary_key"`
-	CreatedAt time.Time
-	ProjectId int64
-	Name      string
+	Id             int64 `gorm:"primary_key"`
+	CreatedAt      time.Time
+	ProjectId      int64
+	Name           string
+	DimensionCount int
+	// Replicates is how many uploaded replicates were combined into the
+	// control's values, using Aggregate.
+	Replicates int
+	Aggregate  string
+	// The status of the last recompute of the control's samples, and how
+	// many of them it got through.
+	RecomputeStatus string
+	RecomputeError  string
+	RecomputeDone   int
+	RecomputeTotal  int
+}
+
+func (c Control) Partial(project_dimensions int) bool {
+	return c.DimensionCount < project_dimensions
 }
 
 type ControlValue struct {
 	ControlId   int64
 	DimensionId int64
 	Value       float64
+	StdDev      float64
 	Rank        int
 }
 
+type SearchJob struct {
+	Id           int64 `gorm:"primary_key"`
+	CreatedAt    time.Time
+	FinishedAt   *time.Time
+	ProjectId    int64
+	UserId       string
+	Status       string
+	Error        string
+	Scored       int
+	Total        int
+	SearchType   string
+	Params       string
+	DetailParams string
+	Stale        bool
+}
+
+// Param returns a search form value the job was submitted with.
+func (j SearchJob) Param(name string) string {
+	params, err := url.ParseQuery(j.Params)
+	if err != nil {
+		return ""
+	}
+	return params.Get(name)
+}
+
+type SearchJobResult struct {
+	SearchJobId int64
+	SampleId    int64
+	Score       float64
+}
+
+// AuditEvent records a change to the data. ProjectId is 0 for changes that
+// don't belong to a project, such as API keys.
+type AuditEvent struct {
+	Id         int64 `gorm:"primary_key"`
+	CreatedAt  time.Time
+	ProjectId  int64
+	UserId     string
+	APIKeyId   int64
+	Action     string
+	ObjectType string
+	ObjectId   int64
+	Detail     string
+	RemoteAddr string
+	UserAgent  string
+}
+
 func (d *Data) CreateDB() error {
 	var errs errors.ErrorGroup
 	tx := d.db.Begin()
 
+	errs.Add(tx.Exec(`CREATE SEQUENCE api_keys_id_seq;`).Error)
 	errs.Add(tx.Exec(`CREATE TABLE
 	  api_keys (
+  	  id bigint NOT NULL DEFAULT nextval('api_keys_id_seq'),
   	  user_id character varying(255) NOT NULL,
-  	  key character varying(255) NOT NULL
+  	  name character varying(255) NOT NULL,
+  	  hash character varying(64) NOT NULL,
+  	  prefix character varying(16) NOT NULL,
+  	  created_at timestamp with time zone NOT NULL,
+  	  last_used_at timestamp with time zone,
+  	  expires_at timestamp with time zone,
+  	  read_only boolean NOT NULL,
+  	  projects text NOT NULL
 	  );`).Error)
 	errs.Add(tx.Exec(`CREATE INDEX
 	  idx_api_keys_user_id ON api_keys(user_id);`).Error)
 	errs.Add(tx.Exec(`CREATE UNIQUE INDEX
-	  idx_api_keys_key ON api_keys(key);`).Error)
+	  idx_api_keys_hash ON api_keys(hash);`).Error)
 
 	errs.Add(tx.Exec(`CREATE SEQUENCE projects_id_seq;`).Error)
 	errs.Add(tx.Exec(`CREATE TABLE
@@ -108,35 +261,21 @@ func (d *Data) CreateDB() error {
       control_id bigint NOT NULL,
       created_at timestamp with time zone NOT NULL,
       project_id bigint NOT NULL,
-      name character varying(255) NOT NULL
+      name character varying(255) NOT NULL,
+      dimension_count integer NOT NULL,
+      normalization character varying(16) NOT NULL,
+      norm_controls text NOT NULL,
+      diff_type character varying(16) NOT NULL
     );`).Error)
 	errs.Add(tx.Exec(`CREATE UNIQUE INDEX
 	  idx_samples_project_id_name ON samples(project_id, name);`).Error)
-
-	errs.Add(tx.Exec(`CREATE TABLE
-    sample_values (
-      sample_id bigint NOT NULL,
-      dimension_id bigint NOT NULL,
-
-      rank integer NOT NULL,
-      rank_diff integer NOT NULL,
-      abs_rank_diff integer NOT NULL,
-
-      value real NOT NULL,
-      value_diff real NOT NULL,
-      abs_value_diff real NOT NULL,
-
-      primary key(sample_id, dimension_id)
-    );`).Error)
-	errs.Add(tx.Exec(`CREATE INDEX
-	  idx_sample_values_sample_id_abs_rank_diff ON
-	      sample_values(sample_id, abs_rank_diff);`).Error)
-	errs.Add(tx.Exec(`CREATE INDEX
-	  idx_sample_values_sample_id_rank_diff ON
-	      sample_values(sample_id, rank_diff);`).Error)
 	errs.Add(tx.Exec(`CREATE INDEX
-	  idx_sample_values_sample_id_abs_value_diff ON
-	      sample_values(sample_id, abs_value_diff);`).Error)
+	  idx_samples_control_id ON samples(control_id);`).Error)
+
+	d.samples.createTables(tx, &errs)
+	createSettingsTables(tx, &errs)
+	errs.Add(tx.Create(&Setting{Name: settingSampleStorage,
+		Value: d.samples.mode()}).Error)
 
 	errs.Add(tx.Exec(`CREATE SEQUENCE controls_id_seq;`).Error)
 	errs.Add(tx.Exec(`CREATE TABLE
@@ -144,7 +283,14 @@ func (d *Data) CreateDB() error {
       id bigint NOT NULL DEFAULT nextval('controls_id_seq'),
       created_at timestamp with time zone NOT NULL,
       project_id bigint NOT NULL,
-      name character varying(255) NOT NULL
+      name character varying(255) NOT NULL,
+      dimension_count integer NOT NULL,
+      replicates integer NOT NULL,
+      aggregate character varying(16) NOT NULL,
+      recompute_status character varying(16) NOT NULL,
+      recompute_error text NOT NULL,
+      recompute_done integer NOT NULL,
+      recompute_total integer NOT NULL
     );`).Error)
 	errs.Add(tx.Exec(`CREATE UNIQUE INDEX
 	  idx_controls_project_id_name ON controls(project_id, name);`).Error)
@@ -155,11 +301,19 @@ func (d *Data) CreateDB() error {
       dimension_id bigint NOT NULL,
       rank integer NOT NULL,
       value real NOT NULL,
+      std_dev real NOT NULL,
       primary key(control_id, dimension_id)
     );`).Error)
 	errs.Add(tx.Exec(`CREATE INDEX
 	  idx_control_values_control_id_rank ON
 	      control_values(control_id, rank);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX
+	  idx_control_values_control_id_value ON
+	      control_values(control_id, value);`).Error)
+
+	createSearchJobTables(tx, &errs)
+
+	createAuditTables(tx, &errs)
 
 	err := errs.Finalize()
 	if err != nil {
@@ -170,3 +324,75 @@ func (d *Data) CreateDB() error {
 	tx.Commit()
 	return nil
 }
+
+// createSearchJobTables also brings older databases up to date, so it
+// must not fail if the tables exist.
+func createSearchJobTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`CREATE SEQUENCE IF NOT EXISTS search_jobs_id_seq;`).Error)
+	errs.Add(tx.Exec(`CREATE TABLE IF NOT EXISTS
+    search_jobs (
+      id bigint NOT NULL DEFAULT nextval('search_jobs_id_seq'),
+      created_at timestamp with time zone NOT NULL,
+      finished_at timestamp with time zone,
+      project_id bigint NOT NULL,
+      user_id character varying(255) NOT NULL,
+      status character varying(16) NOT NULL,
+      error text NOT NULL,
+      scored integer NOT NULL,
+      total integer NOT NULL,
+      search_type character varying(32) NOT NULL,
+      params text NOT NULL,
+      detail_params text NOT NULL,
+      stale boolean NOT NULL
+    );`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_search_jobs_project_id_user_id_created_at ON
+	      search_jobs(project_id, user_id, created_at);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_search_jobs_status ON search_jobs(status);`).Error)
+
+	errs.Add(tx.Exec(`CREATE TABLE IF NOT EXISTS
+    search_job_results (
+      search_job_id bigint NOT NULL,
+      sample_id bigint NOT NULL,
+      score real NOT NULL,
+      primary key(search_job_id, sample_id)
+    );`).Error)
+}
+
+// createAuditTables also brings older databases up to date, so it must not
+// fail if the tables exist.
+func createAuditTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`CREATE SEQUENCE IF NOT EXISTS audit_events_id_seq;`).Error)
+	errs.Add(tx.Exec(`CREATE TABLE IF NOT EXISTS
+    audit_events (
+      id bigint NOT NULL DEFAULT nextval('audit_events_id_seq'),
+      created_at timestamp with time zone NOT NULL,
+      project_id bigint NOT NULL,
+      user_id character varying(255) NOT NULL,
+      api_key_id bigint NOT NULL,
+      action character varying(32) NOT NULL,
+      object_type character varying(32) NOT NULL,
+      object_id bigint NOT NULL,
+      detail text NOT NULL,
+      remote_addr character varying(64) NOT NULL,
+      user_agent text NOT NULL
+    );`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_audit_events_project_id_created_at ON
+	      audit_events(project_id, created_at);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_audit_events_user_id_created_at ON
+	      audit_events(user_id, created_at);`).Error)
+}
+
+// createSettingsTables also brings older databases up to date, so it must
+// not fail if the tables exist.
+func createSettingsTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`CREATE TABLE IF NOT EXISTS
+    settings (
+      name character varying(64) NOT NULL,
+      value text NOT NULL,
+      primary key(name)
+    );`).Error)
+}
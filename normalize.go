@@ -0,0 +1,240 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Normalization string
+
+const (
+	NormNone     Normalization = ""
+	NormLog2     Normalization = "log2"
+	NormZScore   Normalization = "zscore"
+	NormQuantile Normalization = "quantile"
+	NormRobustZ  Normalization = "robust_z"
+
+	// madScale makes the median absolute deviation estimate the standard
+	// deviation of normally distributed values.
+	madScale = 1.4826
+)
+
+var Normalizations = []Normalization{
+	NormNone, NormLog2, NormZScore, NormQuantile, NormRobustZ}
+
+func (n Normalization) Valid() bool {
+	for _, valid := range Normalizations {
+		if n == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func (n Normalization) Description() string {
+	switch n {
+	case NormLog2:
+		return "log2(x+1)"
+	case NormZScore:
+		return "z-score across dimensions"
+	case NormQuantile:
+		return "quantile normalized to the control"
+	case NormRobustZ:
+		return "robust z-score against controls"
+	}
+	return "none"
+}
+
+// NormalizeOptions is how a sample's values are normalized before they are
+// ranked and compared to its control. Controls lists the reference controls
+// for NormRobustZ.
+type NormalizeOptions struct {
+	Method   Normalization
+	Controls []int64
+}
+
+func (o NormalizeOptions) controlList() string {
+	ids := make([]string, 0, len(o.Controls))
+	for _, id := range o.Controls {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+// Normalizer rewrites the values of a whole submission in place.
+type Normalizer func(entries rankList) error
+
+// normalizer builds the Normalizer for opts. control_values are the values of
+// the sample's control, and refs holds the values of each of opts.Controls.
+func normalizer(opts NormalizeOptions, control_values []ControlValue,
+	refs [][]ControlValue) (Normalizer, error) {
+	switch opts.Method {
+	case NormNone:
+		return nil, nil
+	case NormLog2:
+		return normalizeLog2, nil
+	case NormZScore:
+		return normalizeZScore, nil
+	case NormQuantile:
+		targets := make([]float64, 0, len(control_values))
+		for _, val := range control_values {
+			targets = append(targets, val.Value)
+		}
+		sort.Float64s(targets)
+		return func(entries rankList) error {
+			return normalizeQuantile(entries, targets)
+		}, nil
+	case NormRobustZ:
+		if len(refs) == 0 {
+			return nil, ErrBadValues.New(
+				"robust z-score needs at least one reference control")
+		}
+		return robustZ(refs), nil
+	}
+	return nil, ErrBadValues.New("unknown normalization %#v", opts.Method)
+}
+
+func normalizeLog2(entries rankList) error {
+	for i := range entries {
+		if entries[i].val <= -1 {
+			return ErrBadValues.New("log2(x+1) needs values above -1")
+		}
+		entries[i].val = math.Log2(entries[i].val + 1)
+	}
+	return nil
+}
+
+func normalizeZScore(entries rankList) error {
+	var sum, sum_sq float64
+	n := 0
+	for _, entry := range entries {
+		if math.IsNaN(entry.val) {
+			continue
+		}
+		sum += entry.val
+		sum_sq += entry.val * entry.val
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	mean := sum / float64(n)
+	stddev := math.Sqrt(math.Max(sum_sq/float64(n)-mean*mean, 0))
+	if stddev == 0 {
+		return ErrBadValues.New("z-score of values that are all the same")
+	}
+	for i := range entries {
+		entries[i].val = (entries[i].val - mean) / stddev
+	}
+	return nil
+}
+
+// normalizeQuantile replaces each value with the target of the same rank.
+// Tied values share the mean of their targets.
+func normalizeQuantile(entries rankList, targets []float64) error {
+	if len(targets) != len(entries) {
+		return ErrBadDims.New(
+			"submission dimensions don't match control dimensions")
+	}
+	sort.Sort(entries)
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[end].val == entries[start].val {
+			end++
+		}
+		var sum float64
+		for _, target := range targets[start:end] {
+			sum += target
+		}
+		for i := start; i < end; i++ {
+			entries[i].val = sum / float64(end-start)
+		}
+		start = end
+	}
+	return nil
+}
+
+// robustZ scores each dimension against the median and median absolute
+// deviation of that dimension across refs. Dimensions that don't vary across
+// refs are only centered.
+func robustZ(refs [][]ControlValue) Normalizer {
+	by_dim := map[int64][]float64{}
+	for _, ref := range refs {
+		for _, val := range ref {
+			by_dim[val.DimensionId] = append(by_dim[val.DimensionId], val.Value)
+		}
+	}
+	type center struct{ median, scale float64 }
+	centers := make(map[int64]center, len(by_dim))
+	for dim_id, vals := range by_dim {
+		m := median(vals)
+		devs := make([]float64, len(vals))
+		for i, val := range vals {
+			devs[i] = math.Abs(val - m)
+		}
+		scale := madScale * median(devs)
+		if scale == 0 {
+			scale = 1
+		}
+		centers[dim_id] = center{median: m, scale: scale}
+	}
+	return func(entries rankList) error {
+		for i := range entries {
+			c, ok := centers[entries[i].id]
+			if !ok {
+				return ErrBadDims.New("dimension not covered by reference controls")
+			}
+			entries[i].val = (entries[i].val - c.median) / c.scale
+		}
+		return nil
+	}
+}
+
+func median(vals []float64) float64 {
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n == 0 {
+		return math.NaN()
+	}
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// referenceValues normalizes control_values the same way as a sample and
+// reranks them, giving the values and ranks the sample is compared against.
+func referenceValues(control_values []ControlValue, norm Normalizer) (
+	map[int64]*ControlValue, error) {
+	lookup := make(map[int64]*ControlValue, len(control_values))
+	if norm == nil {
+		for i := range control_values {
+			lookup[control_values[i].DimensionId] = &control_values[i]
+		}
+		return lookup, nil
+	}
+	originals := make(map[int64]*ControlValue, len(control_values))
+	entries := make(rankList, 0, len(control_values))
+	for i, val := range control_values {
+		originals[val.DimensionId] = &control_values[i]
+		entries = append(entries,
+			rankEntry{id: val.DimensionId, raw: val.Value, val: val.Value})
+	}
+	err := norm(entries)
+	if err != nil {
+		return nil, err
+	}
+	return lookup, entries.Rank(
+		func(entry rankEntry, value float64, rank int) error {
+			normalized := *originals[entry.id]
+			normalized.Value, normalized.Rank = value, rank
+			lookup[entry.id] = &normalized
+			return nil
+		})
+}
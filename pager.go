@@ -0,0 +1,162 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+var (
+	sampleValueSorts = []string{"rank", "rank_diff", "abs_rank_diff",
+		"raw_value", "value", "value_diff", "abs_value_diff"}
+	controlValueSorts = []string{"rank", "value", "std_dev"}
+)
+
+// Pager describes one page of a longer list. It builds the links to the
+// other pages and orderings of the list, keeping the rest of the request's
+// parameters.
+type Pager struct {
+	Offset, Limit, Total int
+
+	// Sort is the column to sort by, if the list is sortable, and Filter is a
+	// dimension name substring to filter by.
+	Sort   string
+	Desc   bool
+	Filter string
+
+	params url.Values
+}
+
+// parsePager reads the offset, limit, sort, order and filter parameters
+// from form. sort must be one of sorts, or it is default_sort.
+func parsePager(form url.Values, sorts []string, default_sort string,
+	default_desc bool) *Pager {
+	p := &Pager{
+		Limit:  DefaultPageSize,
+		Sort:   default_sort,
+		Desc:   default_desc,
+		Filter: strings.TrimSpace(form.Get("filter")),
+		params: url.Values{}}
+	if offset, err := strconv.Atoi(form.Get("offset")); err == nil &&
+		offset > 0 {
+		p.Offset = offset
+	}
+	if limit, err := strconv.Atoi(form.Get("limit")); err == nil &&
+		limit > 0 && limit <= MaxPageSize {
+		p.Limit = limit
+	}
+	for _, sort := range sorts {
+		if form.Get("sort") == sort {
+			p.Sort = sort
+			p.Desc = form.Get("order") != "asc"
+		}
+	}
+	for key, vals := range form {
+		switch key {
+		case "offset", "sort", "order", "filter", "csrf_token", "api_key":
+		default:
+			p.params[key] = vals
+		}
+	}
+	return p
+}
+
+// OrderBy is the SQL ordering for the pager's sort column.
+func (p *Pager) OrderBy() string {
+	if p.Desc {
+		return p.Sort + " desc"
+	}
+	return p.Sort + " asc"
+}
+
+func (p *Pager) First() int {
+	if p.Total == 0 {
+		return 0
+	}
+	return p.Offset + 1
+}
+
+func (p *Pager) End() int {
+	if p.Offset+p.Limit > p.Total {
+		return p.Total
+	}
+	return p.Offset + p.Limit
+}
+
+func (p *Pager) HasPrev() bool { return p.Offset > 0 }
+func (p *Pager) HasNext() bool { return p.Offset+p.Limit < p.Total }
+
+func (p *Pager) url(offset int, sort string, desc bool) string {
+	params := url.Values{}
+	for key, vals := range p.params {
+		params[key] = vals
+	}
+	if offset > 0 {
+		params.Set("offset", strconv.Itoa(offset))
+	}
+	if sort != "" {
+		params.Set("sort", sort)
+		if desc {
+			params.Set("order", "desc")
+		} else {
+			params.Set("order", "asc")
+		}
+	}
+	if p.Filter != "" {
+		params.Set("filter", p.Filter)
+	}
+	return "?" + params.Encode()
+}
+
+func (p *Pager) PrevURL() string {
+	offset := p.Offset - p.Limit
+	if offset < 0 {
+		offset = 0
+	}
+	return p.url(offset, p.Sort, p.Desc)
+}
+
+func (p *Pager) NextURL() string {
+	return p.url(p.Offset+p.Limit, p.Sort, p.Desc)
+}
+
+// SortURL links to the first page sorted by sort, flipping the order if the
+// list is already sorted by it.
+func (p *Pager) SortURL(sort string) string {
+	return p.url(0, sort, sort != p.Sort || !p.Desc)
+}
+
+// SortMark returns an arrow if the list is sorted by sort.
+func (p *Pager) SortMark(sort string) string {
+	if sort != p.Sort {
+		return ""
+	}
+	if p.Desc {
+		return "▾"
+	}
+	return "▴"
+}
+
+// Results returns the page's part of results, setting Total.
+func (p *Pager) Results(results SearchResults) SearchResults {
+	p.Total = len(results)
+	if p.Offset >= len(results) {
+		return nil
+	}
+	return results[p.Offset:p.End()]
+}
+
+// likePattern matches names containing substr, case insensitively, with
+// LIKE ... ESCAPE '\'.
+func likePattern(substr string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(
+		strings.ToLower(substr)) + "%"
+}
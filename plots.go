@@ -0,0 +1,194 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+)
+
+const (
+	plotWidth     = 600
+	plotHeight    = 300
+	plotMargin    = 40
+	histogramBins = 50
+)
+
+// plot draws an SVG chart mapping the data ranges onto the drawing area
+// inside the margins.
+type plot struct {
+	buf                        bytes.Buffer
+	x_min, x_max, y_min, y_max float64
+}
+
+func newPlot(x_min, x_max, y_min, y_max float64,
+	title, x_label, y_label string) *plot {
+	if !(x_max > x_min) {
+		x_min, x_max = x_min-1, x_min+1
+	}
+	if !(y_max > y_min) {
+		y_min, y_max = y_min-1, y_min+1
+	}
+	p := &plot{x_min: x_min, x_max: x_max, y_min: y_min, y_max: y_max}
+	fmt.Fprintf(&p.buf, `<svg xmlns="http://www.w3.org/2000/svg" `+
+		`width="%d" height="%d" viewBox="0 0 %d %d" `+
+		`font-family="sans-serif" font-size="10">`,
+		plotWidth, plotHeight, plotWidth, plotHeight)
+	fmt.Fprintf(&p.buf, `<rect x="%d" y="%d" width="%d" height="%d" `+
+		`fill="none" stroke="#999"/>`, plotMargin, plotMargin,
+		plotWidth-2*plotMargin, plotHeight-2*plotMargin)
+	fmt.Fprintf(&p.buf, `<text x="%d" y="%d" text-anchor="middle" `+
+		`font-size="12">%s</text>`, plotWidth/2, plotMargin/2,
+		html.EscapeString(title))
+	fmt.Fprintf(&p.buf, `<text x="%d" y="%d" text-anchor="middle">%s</text>`,
+		plotWidth/2, plotHeight-plotMargin/4, html.EscapeString(x_label))
+	fmt.Fprintf(&p.buf, `<text x="%d" y="%d" text-anchor="middle" `+
+		`transform="rotate(-90 %d %d)">%s</text>`, plotMargin/4, plotHeight/2,
+		plotMargin/4, plotHeight/2, html.EscapeString(y_label))
+	p.label(p.x(x_min), plotHeight-plotMargin+12, "start", x_min)
+	p.label(p.x(x_max), plotHeight-plotMargin+12, "end", x_max)
+	p.label(plotMargin-2, p.y(y_min), "end", y_min)
+	p.label(plotMargin-2, p.y(y_max)+8, "end", y_max)
+	return p
+}
+
+func (p *plot) label(x, y float64, anchor string, val float64) {
+	fmt.Fprintf(&p.buf, `<text x="%.1f" y="%.1f" text-anchor="%s">%.3g</text>`,
+		x, y, anchor, val)
+}
+
+func (p *plot) x(val float64) float64 {
+	return plotMargin + (val-p.x_min)/(p.x_max-p.x_min)*
+		(plotWidth-2*plotMargin)
+}
+
+func (p *plot) y(val float64) float64 {
+	return plotHeight - plotMargin - (val-p.y_min)/(p.y_max-p.y_min)*
+		(plotHeight-2*plotMargin)
+}
+
+// line draws a line between two points in data coordinates.
+func (p *plot) line(x1, y1, x2, y2 float64, color string) {
+	fmt.Fprintf(&p.buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" `+
+		`stroke="%s"/>`, p.x(x1), p.y(y1), p.x(x2), p.y(y2), color)
+}
+
+func (p *plot) Bytes() []byte {
+	p.buf.WriteString(`</svg>`)
+	return p.buf.Bytes()
+}
+
+func finite(val float64) bool {
+	return !math.IsNaN(val) && !math.IsInf(val, 0)
+}
+
+func bounds(vals []float64) (min, max float64) {
+	min, max = math.Inf(1), math.Inf(-1)
+	for _, val := range vals {
+		if finite(val) {
+			min, max = math.Min(min, val), math.Max(max, val)
+		}
+	}
+	if min > max {
+		return 0, 0
+	}
+	return min, max
+}
+
+// ScatterPlot plots ys against xs with a y = x reference line. Points that
+// land on the same pixel are drawn once, so plots of tens of thousands of
+// dimensions stay small.
+func ScatterPlot(xs, ys []float64, title, x_label, y_label string) []byte {
+	x_min, x_max := bounds(xs)
+	y_min, y_max := bounds(ys)
+	p := newPlot(x_min, x_max, y_min, y_max, title, x_label, y_label)
+	lo, hi := math.Max(x_min, y_min), math.Min(x_max, y_max)
+	if lo < hi {
+		p.line(lo, lo, hi, hi, "#d9534f")
+	}
+	type pixel struct{ x, y int }
+	drawn := map[pixel]bool{}
+	p.buf.WriteString(`<g fill="#2780e3" fill-opacity="0.5">`)
+	for i := range xs {
+		if !finite(xs[i]) || !finite(ys[i]) {
+			continue
+		}
+		px := pixel{x: int(p.x(xs[i])), y: int(p.y(ys[i]))}
+		if drawn[px] {
+			continue
+		}
+		drawn[px] = true
+		fmt.Fprintf(&p.buf, `<circle cx="%d" cy="%d" r="1.5"/>`, px.x, px.y)
+	}
+	p.buf.WriteString(`</g>`)
+	return p.Bytes()
+}
+
+// WaterfallPlot draws vals, which should already be sorted, as bars from
+// zero. Long series are bucketed to one bar per pixel column, keeping the
+// most extreme value of each bucket.
+func WaterfallPlot(vals []float64, title, x_label, y_label string) []byte {
+	y_min, y_max := bounds(vals)
+	y_min, y_max = math.Min(y_min, 0), math.Max(y_max, 0)
+	p := newPlot(0, float64(len(vals)), y_min, y_max, title, x_label, y_label)
+	p.line(0, 0, float64(len(vals)), 0, "#999")
+	buckets := len(vals)
+	if buckets > plotWidth-2*plotMargin {
+		buckets = plotWidth - 2*plotMargin
+	}
+	p.buf.WriteString(`<path stroke="#2780e3" fill="none" d="`)
+	for b := 0; b < buckets; b++ {
+		start := b * len(vals) / buckets
+		end := (b + 1) * len(vals) / buckets
+		val := 0.0
+		for _, v := range vals[start:end] {
+			if finite(v) && math.Abs(v) > math.Abs(val) {
+				val = v
+			}
+		}
+		x := p.x(float64(start))
+		fmt.Fprintf(&p.buf, "M%.1f %.1fV%.1f", x, p.y(0), p.y(val))
+	}
+	p.buf.WriteString(`"/>`)
+	return p.Bytes()
+}
+
+// HistogramPlot draws the distribution of vals over evenly sized bins.
+func HistogramPlot(vals []float64, bins int, title, x_label string) []byte {
+	x_min, x_max := bounds(vals)
+	if !(x_max > x_min) {
+		x_min, x_max = x_min-1, x_min+1
+	}
+	counts := make([]int, bins)
+	highest := 0
+	for _, val := range vals {
+		if !finite(val) {
+			continue
+		}
+		bin := int((val - x_min) / (x_max - x_min) * float64(bins))
+		if bin >= bins {
+			bin = bins - 1
+		}
+		counts[bin] += 1
+		if counts[bin] > highest {
+			highest = counts[bin]
+		}
+	}
+	p := newPlot(x_min, x_max, 0, float64(highest), title, x_label, "count")
+	p.buf.WriteString(`<g fill="#2780e3" stroke="#fff" stroke-width="0.5">`)
+	bin_width := (x_max - x_min) / float64(bins)
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		lo := x_min + float64(i)*bin_width
+		x, y := p.x(lo), p.y(float64(count))
+		fmt.Fprintf(&p.buf, `<rect x="%.1f" y="%.1f" width="%.1f" `+
+			`height="%.1f"/>`, x, y, p.x(lo+bin_width)-x, p.y(0)-y)
+	}
+	p.buf.WriteString(`</g>`)
+	return p.Bytes()
+}
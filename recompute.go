@@ -0,0 +1,421 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+)
+
+const (
+	RecomputeRunning  = "running"
+	RecomputeDone     = "done"
+	RecomputeFailed   = "failed"
+	RecomputeCanceled = "canceled"
+)
+
+// ReplaceControlValues replaces all of a control's values, which must cover
+// the same number of dimensions as before. The control's samples keep their
+// old differences until they are recomputed, so the control is marked as
+// recomputing in the same transaction, and the caller must start the
+// recompute or fail it with FailRecompute.
+func (d *Data) ReplaceControlValues(user *UserInfo, project_id,
+	control_id int64, aggregate Aggregate,
+	values func(deliver func(dim_id int64, replicates []float64) error) error) (
+	err error) {
+
+	err = d.AssertWriteAccess(user, project_id, &control_id)
+	if err != nil {
+		return err
+	}
+
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+
+	var control Control
+	err = tx.Where("id = ?", control_id).First(&control).Error
+	if err != nil {
+		return ErrNotFound.Wrap(err)
+	}
+	if control.RecomputeStatus == RecomputeRunning {
+		return ErrDenied.New("the control's samples are being recomputed")
+	}
+
+	err = tx.Where("control_id = ?", control_id).Delete(ControlValue{}).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+
+	control.Aggregate = string(aggregate)
+	err = storeControlValues(tx.DB, &control, aggregate, values)
+	if err != nil {
+		return err
+	}
+
+	var zscored []Sample
+	err = tx.Where("control_id = ? AND diff_type = ?", control_id,
+		string(DiffZScore)).Limit(1).Find(&zscored).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	if len(zscored) > 0 {
+		err = DiffZScore.checkControl(&control)
+		if err != nil {
+			return ErrBadValues.New("sample %#v has z-scored differences, "+
+				"which need a control with replicates", zscored[0].Name)
+		}
+	}
+
+	err = tx.Model(&control).Updates(map[string]interface{}{
+		"replicates":       control.Replicates,
+		"aggregate":        control.Aggregate,
+		"recompute_status": RecomputeRunning,
+		"recompute_error":  "",
+		"recompute_done":   0,
+		"recompute_total":  0}).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+
+	err = recordAudit(tx.DB, user, project_id, AuditReplace, "control",
+		control.Id, control.Name)
+	if err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// RecomputeSamples regenerates the values of every sample under the control
+// from their stored raw values, reporting each recomputed sample to the ctx's
+// Progress, if any. Samples under other controls that are robust z-scored
+// against the control are recomputed too. Like NewSample, each sample is
+// stored in its own transaction, so a failure leaves every sample either
+// recomputed or as it was.
+func (d *Data) RecomputeSamples(ctx context.Context, user *UserInfo,
+	project_id, control_id int64) error {
+	progress := ProgressFromContext(ctx)
+
+	samples, err := d.dependentSamples(project_id, control_id)
+	if err != nil {
+		return err
+	}
+	progress.Start(len(samples))
+
+	control_values := map[int64][]ControlValue{}
+	for i := range samples {
+		if ctx.Err() != nil {
+			return ErrCanceled.Wrap(ctx.Err())
+		}
+		values, loaded := control_values[samples[i].ControlId]
+		if !loaded {
+			values, err = d.ControlValues(samples[i].ControlId)
+			if err != nil {
+				return err
+			}
+			control_values[samples[i].ControlId] = values
+		}
+		err = d.recomputeSample(user, &samples[i], values)
+		if err != nil {
+			return err
+		}
+		progress.Add(1)
+	}
+	return nil
+}
+
+// dependentSamples returns the samples whose values depend on the control's
+// values: the samples under it, and the samples robust z-scored against it.
+func (d *Data) dependentSamples(project_id, control_id int64) (
+	samples []Sample, err error) {
+	var candidates []Sample
+	err = d.db.Where("project_id = ? AND (control_id = ? OR "+
+		"normalization = ?)", project_id, control_id, string(NormRobustZ)).Order(
+		"id asc").Find(&candidates).Error
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	for _, sample := range candidates {
+		if sample.ControlId == control_id || sample.normalizedAgainst(
+			control_id) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+func (d *Data) recomputeSample(user *UserInfo, sample *Sample,
+	control_values []ControlValue) error {
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+
+	err := d.rewriteSampleValues(tx.DB, sample, control_values)
+	if err != nil {
+		return err
+	}
+
+	err = markSearchesStale(tx.DB, sample.ProjectId)
+	if err != nil {
+		return err
+	}
+
+	err = recordAudit(tx.DB, user, sample.ProjectId, AuditRecompute, "sample",
+		sample.Id, sample.Name)
+	if err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// rewriteSampleValues replaces the sample's values with ones recomputed from
+// its raw values against control_values.
+func (d *Data) rewriteSampleValues(tx *gorm.DB, sample *Sample,
+	control_values []ControlValue) error {
+	if sample.DimensionCount != len(control_values) {
+		return ErrBadDims.New("sample %#v doesn't cover the control's "+
+			"dimensions", sample.Name)
+	}
+
+	raw, err := d.samples.get(tx, sample.Id)
+	if err != nil {
+		return err
+	}
+	norm, control_lookup, err := d.sampleReference(sample.ProjectId,
+		control_values, sample.NormalizeOptions())
+	if err != nil {
+		return err
+	}
+
+	return d.storeSampleValues(tx, sample, norm, control_lookup,
+		func(deliver func(dim_id int64, value float64) error) error {
+			for _, val := range raw {
+				err := deliver(val.DimensionId, val.RawValue)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+// MoveSample reassigns a sample to another of the project's controls and
+// recomputes its values against the new control's values. The user needs
+// write access to both controls.
+func (d *Data) MoveSample(user *UserInfo, project_id, sample_id,
+	control_id int64) error {
+	_, sample, err := d.Sample(user, project_id, sample_id)
+	if err != nil {
+		return err
+	}
+	if sample.ControlId == control_id {
+		return nil
+	}
+	for _, id := range []int64{sample.ControlId, control_id} {
+		err = d.AssertWriteAccess(user, project_id, &id)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+
+	var running int
+	err = tx.Model(Control{}).Where("id IN (?) AND recompute_status = ?",
+		[]int64{sample.ControlId, control_id}, RecomputeRunning).Count(
+		&running).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	if running > 0 {
+		return ErrDenied.New("the control's samples are being recomputed")
+	}
+
+	var control Control
+	err = tx.Where("id = ?", control_id).First(&control).Error
+	if err != nil {
+		return ErrNotFound.Wrap(err)
+	}
+	err = DiffType(sample.DiffType).checkControl(&control)
+	if err != nil {
+		return err
+	}
+
+	var control_values []ControlValue
+	err = tx.Where("control_id = ?", control_id).Find(&control_values).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+
+	from := sample.ControlId
+	sample.ControlId = control_id
+	err = tx.Model(sample).Update("control_id", control_id).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+
+	err = d.rewriteSampleValues(tx.DB, sample, control_values)
+	if err != nil {
+		return err
+	}
+
+	err = markSearchesStale(tx.DB, project_id)
+	if err != nil {
+		return err
+	}
+
+	err = recordAudit(tx.DB, user, project_id, AuditMove, "sample", sample.Id,
+		fmt.Sprintf("%s: control %d to %d", sample.Name, from, control_id))
+	if err != nil {
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// FailRecompute marks the control's recompute as failed with cause, such as
+// when it couldn't be started.
+func (d *Data) FailRecompute(control_id int64, cause error) error {
+	return d.setRecompute(control_id, map[string]interface{}{
+		"recompute_status": RecomputeFailed,
+		"recompute_error":  cause.Error()})
+}
+
+func (d *Data) setRecompute(control_id int64,
+	fields map[string]interface{}) error {
+	return Err.Wrap(d.db.Model(&Control{Id: control_id}).Updates(
+		fields).Error)
+}
+
+// FailInterruptedRecomputes marks recomputes that were still running when
+// the server last stopped as failed.
+func (d *Data) FailInterruptedRecomputes() error {
+	return Err.Wrap(d.db.Model(Control{}).Where("recompute_status = ?",
+		RecomputeRunning).Updates(map[string]interface{}{
+		"recompute_status": RecomputeFailed,
+		"recompute_error":  "interrupted by server restart"}).Error)
+}
+
+type runningRecompute struct {
+	progress Progress
+	cancel   context.CancelFunc
+}
+
+// Recomputes runs sample recomputes in the background, at most one per
+// control, and keeps track of their progress until their status is stored.
+type Recomputes struct {
+	data *Data
+
+	mtx     sync.Mutex
+	running map[int64]*runningRecompute
+	wg      sync.WaitGroup
+}
+
+func NewRecomputes(data *Data) *Recomputes {
+	return &Recomputes{
+		data:    data,
+		running: map[int64]*runningRecompute{}}
+}
+
+// Start begins recomputing the samples of the control, on behalf of user.
+func (r *Recomputes) Start(user *UserInfo, project_id,
+	control_id int64) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &runningRecompute{cancel: cancel}
+	ctx = WithProgress(ctx, &rc.progress)
+
+	r.mtx.Lock()
+	_, running := r.running[control_id]
+	if !running {
+		r.running[control_id] = rc
+	}
+	r.mtx.Unlock()
+	if running {
+		cancel()
+		return ErrDenied.New("the control's samples are being recomputed")
+	}
+
+	err := r.data.setRecompute(control_id, map[string]interface{}{
+		"recompute_status": RecomputeRunning,
+		"recompute_error":  "",
+		"recompute_done":   0,
+		"recompute_total":  0})
+	if err != nil {
+		r.mtx.Lock()
+		delete(r.running, control_id)
+		r.mtx.Unlock()
+		cancel()
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		err := r.data.RecomputeSamples(ctx, user, project_id, control_id)
+		status, msg := RecomputeDone, ""
+		if err != nil {
+			status, msg = RecomputeFailed, err.Error()
+			if ErrCanceled.Contains(err) {
+				status = RecomputeCanceled
+			}
+		}
+		done, total := rc.progress.Get()
+		ferr := r.data.setRecompute(control_id, map[string]interface{}{
+			"recompute_status": status,
+			"recompute_error":  msg,
+			"recompute_done":   done,
+			"recompute_total":  total})
+		if ferr != nil {
+			log.Printf("failed storing recompute of control %d: %v",
+				control_id, ferr)
+		}
+		r.mtx.Lock()
+		delete(r.running, control_id)
+		r.mtx.Unlock()
+	}()
+	return nil
+}
+
+// Status returns the live progress of a control's recompute. If running is
+// false, the control's stored recompute fields are authoritative.
+func (r *Recomputes) Status(control_id int64) (done, total int,
+	running bool) {
+	r.mtx.Lock()
+	rc, running := r.running[control_id]
+	r.mtx.Unlock()
+	if !running {
+		return 0, 0, false
+	}
+	done, total = rc.progress.Get()
+	return done, total, true
+}
+
+// Stop cancels all running recomputes and waits until their status is
+// stored or ctx is done, whichever is first.
+func (r *Recomputes) Stop(ctx context.Context) {
+	r.mtx.Lock()
+	for _, rc := range r.running {
+		rc.cancel()
+	}
+	r.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -17,9 +18,20 @@ import (
 	"gopkg.in/webhelp.v1/whredir"
 )
 
+var (
+	brand = flag.String("brand", "JT's Connectivity Workbench!",
+		"the name shown in the page title and navigation bar")
+	customCSS = flag.String("custom_css", "",
+		"path to a stylesheet loaded after the default ones, for branding")
+)
+
 type PageCtx struct {
 	User      *UserInfo
+	LoginURL  string
 	LogoutURL string
+	CSRFToken string
+	Brand     string
+	CustomCSS bool
 	Page      map[string]interface{}
 }
 
@@ -40,6 +52,14 @@ func (r Renderer) Render(logic Logic) http.Handler {
 		func(w http.ResponseWriter, req *http.Request) {
 			ctx := whcompat.Context(req)
 			user := LoadUser(ctx)
+			err := checkCSRF(ctx, req, user)
+			if err != nil {
+				whfatal.Error(err)
+			}
+			token, err := csrfToken(ctx, w)
+			if err != nil {
+				whfatal.Error(err)
+			}
 			tmpl, page, err := logic(ctx, req, user)
 			if err != nil {
 				whfatal.Error(err)
@@ -52,7 +72,11 @@ func (r Renderer) Render(logic Logic) http.Handler {
 			w.Header().Set("Content-Type", "text/html")
 			err = t.Execute(w, PageCtx{
 				User:      user,
+				LoginURL:  oauth2.LoginURL(req.RequestURI, false),
 				LogoutURL: oauth2.LogoutURL("/"),
+				CSRFToken: token,
+				Brand:     *brand,
+				CustomCSS: *customCSS != "",
 				Page:      page})
 			if err != nil {
 				whfatal.Error(err)
@@ -65,7 +89,28 @@ type Handler func(w http.ResponseWriter, req *http.Request, user *UserInfo)
 func (r Renderer) Process(logic Handler) http.Handler {
 	return whmux.ExactPath(http.HandlerFunc(
 		func(w http.ResponseWriter, req *http.Request) {
-			logic(w, req, LoadUser(whcompat.Context(req)))
+			ctx := whcompat.Context(req)
+			user := LoadUser(ctx)
+			err := checkCSRF(ctx, req, user)
+			if err != nil {
+				whfatal.Error(err)
+			}
+			logic(w, req, user)
+		}))
+}
+
+// ProcessUpload is like Process, but hands logic the request's streamed
+// Upload instead of a parsed form.
+func (r Renderer) ProcessUpload(logic UploadHandler) http.Handler {
+	return whmux.ExactPath(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			ctx := whcompat.Context(req)
+			user := LoadUser(ctx)
+			upload, err := readUpload(ctx, req, user)
+			if err != nil {
+				whfatal.Error(err)
+			}
+			logic(w, req, user, upload)
 		}))
 }
 
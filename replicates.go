@@ -0,0 +1,86 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"math"
+)
+
+// Aggregate is how a control's replicates are combined into one value per
+// dimension.
+type Aggregate string
+
+const (
+	AggregateMean   Aggregate = "mean"
+	AggregateMedian Aggregate = "median"
+)
+
+var Aggregates = []Aggregate{AggregateMean, AggregateMedian}
+
+func (a Aggregate) Valid() bool {
+	return a == AggregateMean || a == AggregateMedian
+}
+
+// Of combines replicates, also returning their sample standard deviation,
+// which is 0 for a single replicate.
+func (a Aggregate) Of(replicates []float64) (value, std_dev float64) {
+	var sum float64
+	for _, val := range replicates {
+		sum += val
+	}
+	mean := sum / float64(len(replicates))
+	if len(replicates) > 1 {
+		var sum_sq float64
+		for _, val := range replicates {
+			sum_sq += (val - mean) * (val - mean)
+		}
+		std_dev = math.Sqrt(sum_sq / float64(len(replicates)-1))
+	}
+	if a == AggregateMedian {
+		return median(replicates), std_dev
+	}
+	return mean, std_dev
+}
+
+// DiffType is what a sample's ValueDiff measures.
+type DiffType string
+
+const (
+	// DiffValue is the sample value minus the control value.
+	DiffValue DiffType = ""
+	// DiffZScore is DiffValue in units of the control's replicate standard
+	// deviation. Dimensions that didn't vary across the replicates are left
+	// as plain differences.
+	DiffZScore DiffType = "zscore"
+)
+
+func (t DiffType) Valid() bool {
+	return t == DiffValue || t == DiffZScore
+}
+
+func (t DiffType) Description() string {
+	if t == DiffZScore {
+		return "z-scores against control replicates"
+	}
+	return "value differences"
+}
+
+// checkControl returns an error if differences of this type can't be computed
+// against the control.
+func (t DiffType) checkControl(control *Control) error {
+	if t == DiffZScore && control.Replicates < 2 {
+		return ErrBadValues.New(
+			"z-scored differences need a control with replicates")
+	}
+	return nil
+}
+
+// valueDiff computes a sample value's difference from its control.
+func (t DiffType) valueDiff(value float64, control *ControlValue) float64 {
+	diff := value - control.Value
+	if t == DiffZScore && control.StdDev > 0 {
+		diff /= control.StdDev
+	}
+	return diff
+}
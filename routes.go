@@ -7,8 +7,13 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"strings"
 
+	"github.com/jtolds/cwbench/internal/static"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/webhelp.v1/whfatal"
 	"gopkg.in/webhelp.v1/whlog"
 	"gopkg.in/webhelp.v1/whmux"
@@ -17,19 +22,40 @@ import (
 	"gopkg.in/webhelp.v1/whsess"
 )
 
+const defaultCookieSecret = "abcdef0123456789"
+
 var (
 	listenAddr   = flag.String("addr", ":8080", "address to listen on")
-	cookieSecret = flag.String("cookie_secret", "abcdef0123456789",
+	cookieSecret = flag.String("cookie_secret", defaultCookieSecret,
 		"the secret for securing cookie information")
+	staticDir = flag.String("static_dir", "",
+		"a directory of files to serve in place of the built-in /static/ ones")
+	staticCDNFallback = flag.Bool("static_cdn_fallback", true,
+		"redirect third-party /static/ assets that aren't built in or in "+
+			"static_dir to their CDN, instead of not finding them")
 
 	projectId   = whmux.NewIntArg()
 	controlId   = whmux.NewIntArg()
 	sampleId    = whmux.NewIntArg()
+	searchJobId = whmux.NewIntArg()
+	apiKeyId    = whmux.NewIntArg()
 	controlName = whmux.NewStringArg()
 )
 
+func staticFiles() map[string]string {
+	if *customCSS == "" {
+		return nil
+	}
+	return map[string]string{"css/custom.css": *customCSS}
+}
+
 func main() {
 	flag.Parse()
+	err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	loadOAuth2()
 	secret, err := hex.DecodeString(*cookieSecret)
 	if err != nil {
@@ -48,11 +74,12 @@ func main() {
 	defer data.Close()
 
 	endpoints := NewEndpoints(data)
+	registerJobMetrics(endpoints.Jobs)
 
-	routes := whlog.LogRequests(whlog.Default, whfatal.Catch(
+	routes := instrumentRequests(whlog.LogRequests(scrubbedLogger, limitBody(whfatal.Catch(
 		whsess.HandlerWithStore(whsess.NewCookieStore(secret),
 			whmux.Overlay{
-				Default: endpoints.LoginRequired(whmux.Dir{
+				Default: endpoints.LoginOptional(whmux.Dir{
 					"": whmux.Exact(renderer.Render(endpoints.ProjectList)),
 
 					"project": projectId.ShiftOpt(
@@ -62,8 +89,17 @@ func main() {
 							"sample": sampleId.ShiftOpt(
 								whmux.Dir{
 									"": whmux.RequireGet(renderer.Render(endpoints.Sample)),
-									"similar": whmux.RequireGet(
-										renderer.Render(endpoints.SampleSimilar)),
+									"similar": whmux.ExactPath(whmux.Method{
+										"GET": renderer.Render(endpoints.SampleSimilar),
+										"POST": renderer.Process(
+											endpoints.SearchSimilar),
+									}),
+									"enrichment": whmux.RequireGet(
+										renderer.Render(endpoints.SampleEnrichment)),
+									"plot": whmux.RequireGet(
+										renderer.Process(endpoints.SamplePlot)),
+									"move": whmux.ExactPath(whmux.RequireMethod("POST",
+										renderer.Process(endpoints.MoveSample))),
 								},
 								whmux.ExactPath(whmux.Method{
 									"GET": ProjectRedirector,
@@ -73,25 +109,55 @@ func main() {
 							"control": controlId.ShiftOpt(
 								whmux.Dir{
 									"": whmux.Exact(renderer.Render(endpoints.Control)),
+									"plot": whmux.RequireGet(
+										renderer.Process(endpoints.ControlPlot)),
+									"values": whmux.ExactPath(whmux.RequireMethod("POST",
+										renderer.ProcessUpload(endpoints.ReplaceControlValues))),
+									"recompute": whmux.ExactPath(whmux.Method{
+										"GET":  renderer.Process(endpoints.RecomputeProgress),
+										"POST": renderer.Process(endpoints.RecomputeControl),
+									}),
 									"sample": whmux.ExactPath(whmux.RequireMethod("POST",
-										renderer.Process(endpoints.NewSample))),
+										renderer.ProcessUpload(endpoints.NewSample))),
 								},
 								whmux.ExactPath(whmux.Method{
 									"GET":  ProjectRedirector,
-									"POST": renderer.Process(endpoints.NewControl),
+									"POST": renderer.ProcessUpload(endpoints.NewControl),
 								}),
 							),
 
 							"control_named": controlName.ShiftOpt(
 								whmux.Dir{
 									"sample": whmux.ExactPath(whmux.RequireMethod("POST",
-										renderer.Process(endpoints.NewSampleFromName))),
+										renderer.ProcessUpload(endpoints.NewSampleFromName))),
 								},
 								whmux.RequireGet(ProjectRedirector),
 							),
 
-							"search": whmux.RequireMethod("POST",
-								whmux.ExactPath(renderer.Render(endpoints.Search)),
+							"dimensions": whmux.ExactPath(whmux.RequireMethod("POST",
+								renderer.Process(endpoints.AddDimensions))),
+
+							"compare": whmux.ExactPath(whmux.RequireGet(
+								renderer.Render(endpoints.Compare))),
+
+							"activity": whmux.Exact(LoginRequired(
+								renderer.Render(endpoints.Activity))),
+
+							"search": searchJobId.ShiftOpt(
+								whmux.Dir{
+									"": whmux.Exact(renderer.Render(endpoints.SearchJob)),
+									"progress": whmux.ExactPath(whmux.RequireGet(
+										renderer.Process(endpoints.SearchJobProgress))),
+									"cancel": whmux.ExactPath(whmux.RequireMethod("POST",
+										renderer.Process(endpoints.CancelSearchJob))),
+									"rerun": whmux.ExactPath(whmux.RequireMethod("POST",
+										renderer.Process(endpoints.RerunSearchJob))),
+								},
+								whmux.ExactPath(whmux.Method{
+									"GET": LoginRequired(
+										renderer.Render(endpoints.SearchHistory)),
+									"POST": renderer.Process(endpoints.Search),
+								}),
 							),
 						},
 
@@ -101,16 +167,28 @@ func main() {
 						}),
 					),
 
-					"account": whmux.Dir{
-						"apikeys": whmux.ExactPath(whmux.Method{
-							"GET":  renderer.Render(endpoints.APIKeys),
-							"POST": renderer.Process(endpoints.NewAPIKey),
-						}),
-					},
+					"account": LoginRequired(whmux.Dir{
+						"apikeys": apiKeyId.ShiftOpt(
+							whmux.Dir{
+								"revoke": whmux.ExactPath(whmux.RequireMethod("POST",
+									renderer.Process(endpoints.RevokeAPIKey))),
+							},
+							whmux.ExactPath(whmux.Method{
+								"GET":  renderer.Render(endpoints.APIKeys),
+								"POST": renderer.Render(endpoints.NewAPIKey),
+							}),
+						),
+					}),
 				}),
 				Overlay: whmux.Dir{
 					"auth": oauth2,
-				}})))
+					"static": http.StripPrefix("/static",
+						static.Handler(*staticDir, staticFiles(),
+							*staticCDNFallback)),
+					"healthz": whmux.Exact(http.HandlerFunc(Healthz)),
+					"readyz":  whmux.Exact(http.HandlerFunc(endpoints.Readyz)),
+					"metrics": whmux.Exact(promhttp.Handler()),
+				}})))))
 
 	switch flag.Arg(0) {
 	case "createdb":
@@ -118,11 +196,59 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+	case "migratedb":
+		err := data.MigrateDB()
+		if err != nil {
+			panic(err)
+		}
+	case "convertstorage":
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s convertstorage <%s|%s>\n",
+				os.Args[0], StorageRows, StorageBlobs)
+			os.Exit(1)
+		}
+		err := data.ConvertSampleStorage(flag.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	case "serve":
-		panic(whlog.ListenAndServe(*listenAddr, routes))
+		if *cookieSecret == defaultCookieSecret && !*devMode {
+			fmt.Fprintln(os.Stderr, "refusing to serve with the default "+
+				"cookie_secret. set a secret, or pass -dev for development")
+			os.Exit(1)
+		}
+		err := data.FailInterruptedSearchJobs()
+		if err != nil {
+			panic(err)
+		}
+		err = data.FailInterruptedRecomputes()
+		if err != nil {
+			panic(err)
+		}
+		if missing := static.Missing(*staticDir); len(missing) > 0 {
+			if *staticCDNFallback {
+				log.Printf("static assets not built in or in static_dir, "+
+					"redirecting them to their CDN: %s", strings.Join(missing, ", "))
+			} else {
+				log.Printf("static assets not built in or in static_dir, the UI "+
+					"will be unstyled: %s", strings.Join(missing, ", "))
+			}
+		}
+		err = serve(routes, endpoints)
+		if err != nil {
+			data.Close()
+			log.Fatal(err)
+		}
 	case "routes":
 		whroute.PrintRoutes(os.Stdout, routes)
+	case "audit":
+		err := auditCommand(data, os.Stdout, flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	default:
-		fmt.Printf("Usage: %s <serve|createdb|routes>\n", os.Args[0])
+		fmt.Printf("Usage: %s <serve|createdb|migratedb|convertstorage|routes|audit>\n", os.Args[0])
 	}
 }
@@ -0,0 +1,77 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	readHeaderTimeout = flag.Duration("read_header_timeout", 10*time.Second,
+		"how long a client may take to send request headers")
+	readTimeout = flag.Duration("read_timeout", 5*time.Minute,
+		"how long a client may take to send a whole request, including uploads")
+	writeTimeout = flag.Duration("write_timeout", 5*time.Minute,
+		"how long a response may take to write")
+	idleTimeout = flag.Duration("idle_timeout", 2*time.Minute,
+		"how long to keep idle keep-alive connections open")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30*time.Second,
+		"how long to wait for in-flight requests and searches on shutdown")
+	tlsCert = flag.String("tls_cert", "",
+		"path to a TLS certificate. if set with tls_key, serves HTTPS")
+	tlsKey = flag.String("tls_key", "", "path to the TLS certificate's key")
+)
+
+// serve runs the HTTP server until it fails or the process is asked to stop
+// with SIGINT or SIGTERM. On a signal, it stops accepting connections and
+// waits up to shutdownTimeout for in-flight requests to finish and for
+// background jobs to be canceled and stored.
+func serve(handler http.Handler, jobs interface {
+	Stop(ctx context.Context)
+}) error {
+	srv := &http.Server{
+		Addr:              *listenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		ErrorLog:          log.New(os.Stderr, "http: ", log.LstdFlags)}
+
+	errs := make(chan error, 1)
+	go func() {
+		if *tlsCert != "" || *tlsKey != "" {
+			log.Printf("listening on %s (https)", *listenAddr)
+			errs <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			log.Printf("listening on %s", *listenAddr)
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	jobs.Stop(ctx)
+	return err
+}
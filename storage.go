@@ -0,0 +1,579 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spacemonkeygo/errors"
+)
+
+const (
+	StorageRows  = "rows"
+	StorageBlobs = "blobs"
+
+	vectorFormat = 1
+)
+
+var (
+	sampleStorage = flag.String("sample_storage", StorageRows,
+		"how sample values are stored: \"rows\" keeps a row per sample and "+
+			"dimension, \"blobs\" keeps one compressed vector per sample. it "+
+			"must match the mode the database was created with, which "+
+			"\"convertstorage <mode>\" changes")
+)
+
+// sampleStore keeps the per-dimension values of samples.
+type sampleStore interface {
+	// mode is the sample_storage the store is chosen with.
+	mode() string
+	// createTables also brings older databases up to date, so it must not
+	// fail if the tables exist.
+	createTables(tx *gorm.DB, errs *errors.ErrorGroup)
+	dropTables(tx *gorm.DB, errs *errors.ErrorGroup)
+
+	// put stores all of a sample's values, replacing any it had.
+	put(tx *gorm.DB, sample_id int64, values []SampleValue) error
+	// get returns all of a sample's values, ordered by dimension id.
+	get(db *gorm.DB, sample_id int64) ([]SampleValue, error)
+	// page returns the page of a sample's values the pager asks for, and sets
+	// the pager's Total.
+	page(db *gorm.DB, sample_id int64, pager *Pager) ([]SampleValue, error)
+	// topK returns the k values of a sample ordered first by top_k_type.
+	topK(db *gorm.DB, sample_id int64, k int, top_k_type TopKType) (
+		[]SampleValue, error)
+	// each calls cb with all of the values of every sample in a project.
+	each(db *gorm.DB, project_id int64,
+		cb func(sample_id int64, values []SampleValue) error) error
+}
+
+func newSampleStore(storage string) (sampleStore, error) {
+	switch storage {
+	case StorageRows:
+		return rowStore{}, nil
+	case StorageBlobs:
+		return blobStore{}, nil
+	}
+	return nil, Err.New("unknown sample_storage %#v", storage)
+}
+
+// checkSampleStorage makes sure the database stores samples the way the
+// configured store does. Databases that don't record it yet are let through,
+// since createdb and migratedb record it.
+func (d *Data) checkSampleStorage() error {
+	if !d.db.HasTable("settings") {
+		return nil
+	}
+	var setting Setting
+	err := d.db.Where("name = ?", settingSampleStorage).First(&setting).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	if setting.Value != d.samples.mode() {
+		return Err.New("the database stores samples as %#v, not %#v. use "+
+			"-sample_storage=%s, or convert it with convertstorage",
+			setting.Value, d.samples.mode(), setting.Value)
+	}
+	return nil
+}
+
+// ConvertSampleStorage moves every sample's values to the storage mode to,
+// dropping the tables of the current mode, and records to as the database's
+// mode. It runs in one transaction, so it either converts every sample or
+// none.
+func (d *Data) ConvertSampleStorage(to string) error {
+	store, err := newSampleStore(to)
+	if err != nil {
+		return err
+	}
+	if store.mode() == d.samples.mode() {
+		return nil
+	}
+
+	tx := txWrapper{DB: d.db.Begin()}
+	defer tx.Rollback()
+
+	var errs errors.ErrorGroup
+	store.createTables(tx.DB, &errs)
+	createSettingsTables(tx.DB, &errs)
+	err = errs.Finalize()
+	if err != nil {
+		return err
+	}
+
+	var sample_ids []int64
+	err = tx.Model(Sample{}).Order("id asc").Pluck("id", &sample_ids).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	for _, sample_id := range sample_ids {
+		values, err := d.samples.get(tx.DB, sample_id)
+		if err != nil {
+			return err
+		}
+		err = store.put(tx.DB, sample_id, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.samples.dropTables(tx.DB, &errs)
+	errs.Add(tx.Where("name = ?", settingSampleStorage).Delete(
+		Setting{}).Error)
+	errs.Add(tx.Create(&Setting{Name: settingSampleStorage,
+		Value: store.mode()}).Error)
+	err = errs.Finalize()
+	if err != nil {
+		return err
+	}
+
+	tx.Commit()
+	d.samples = store
+	return nil
+}
+
+// rowStore keeps a sample_values row per sample and dimension, leaving
+// sorting and filtering to the database.
+type rowStore struct{}
+
+func (rowStore) mode() string { return StorageRows }
+
+func (rowStore) createTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`CREATE TABLE IF NOT EXISTS
+    sample_values (
+      sample_id bigint NOT NULL,
+      dimension_id bigint NOT NULL,
+
+      rank integer NOT NULL,
+      rank_diff integer NOT NULL,
+      abs_rank_diff integer NOT NULL,
+
+      raw_value real NOT NULL,
+      value real NOT NULL,
+      value_diff real NOT NULL,
+      abs_value_diff real NOT NULL,
+
+      primary key(sample_id, dimension_id)
+    );`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_sample_values_sample_id_abs_rank_diff ON
+	      sample_values(sample_id, abs_rank_diff);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_sample_values_sample_id_rank_diff ON
+	      sample_values(sample_id, rank_diff);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_sample_values_sample_id_abs_value_diff ON
+	      sample_values(sample_id, abs_value_diff);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_sample_values_sample_id_value_diff ON
+	      sample_values(sample_id, value_diff);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_sample_values_sample_id_rank ON
+	      sample_values(sample_id, rank);`).Error)
+	errs.Add(tx.Exec(`CREATE INDEX IF NOT EXISTS
+	  idx_sample_values_sample_id_value ON
+	      sample_values(sample_id, value);`).Error)
+}
+
+func (rowStore) dropTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`DROP TABLE sample_values;`).Error)
+}
+
+func (rowStore) put(tx *gorm.DB, sample_id int64,
+	values []SampleValue) error {
+	err := tx.Where("sample_id = ?", sample_id).Delete(SampleValue{}).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	for _, val := range values {
+		val = storedPrecision(val)
+		val.SampleId = sample_id
+		err = tx.Create(&val).Error
+		if err != nil {
+			return Err.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (rowStore) get(db *gorm.DB, sample_id int64) (
+	values []SampleValue, err error) {
+	return values, Err.Wrap(db.Where("sample_id = ?", sample_id).Order(
+		"dimension_id asc").Find(&values).Error)
+}
+
+func (rowStore) page(db *gorm.DB, sample_id int64, pager *Pager) (
+	values []SampleValue, err error) {
+	query := db.Model(SampleValue{}).Where("sample_id = ?", sample_id)
+	return values, valuesPage(query, "sample_values", pager, &values)
+}
+
+func (rowStore) topK(db *gorm.DB, sample_id int64, k int,
+	top_k_type TopKType) (values []SampleValue, err error) {
+	return values, Err.Wrap(db.Where("sample_id = ?", sample_id).Order(
+		string(top_k_type)).Order("dimension_id asc").Limit(k).Find(
+		&values).Error)
+}
+
+func (rowStore) each(db *gorm.DB, project_id int64,
+	cb func(sample_id int64, values []SampleValue) error) error {
+	rows, err := db.Table("sample_values").Select("sample_values.*").Joins(
+		"JOIN samples ON samples.id = sample_values.sample_id").Where(
+		"samples.project_id = ?", project_id).Order(
+		"sample_values.sample_id asc").Rows()
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	defer rows.Close()
+
+	var values []SampleValue
+	for rows.Next() {
+		var val SampleValue
+		err = db.ScanRows(rows, &val)
+		if err != nil {
+			return Err.Wrap(err)
+		}
+		if len(values) > 0 && values[0].SampleId != val.SampleId {
+			err = cb(values[0].SampleId, values)
+			if err != nil {
+				return err
+			}
+			values = nil
+		}
+		values = append(values, val)
+	}
+	err = rows.Err()
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	if len(values) > 0 {
+		return cb(values[0].SampleId, values)
+	}
+	return nil
+}
+
+// SampleVector is a sample's values stored as one compressed blob, ordered
+// by dimension id.
+type SampleVector struct {
+	SampleId       int64 `gorm:"primary_key"`
+	DimensionCount int
+	Data           []byte
+}
+
+// blobStore keeps one SampleVector per sample, so reading a sample is a
+// single row, and sorts and filters values in memory.
+type blobStore struct{}
+
+func (blobStore) mode() string { return StorageBlobs }
+
+func (blobStore) createTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`CREATE TABLE IF NOT EXISTS
+    sample_vectors (
+      sample_id bigint NOT NULL,
+      dimension_count integer NOT NULL,
+      data bytea NOT NULL,
+      primary key(sample_id)
+    );`).Error)
+}
+
+func (blobStore) dropTables(tx *gorm.DB, errs *errors.ErrorGroup) {
+	errs.Add(tx.Exec(`DROP TABLE sample_vectors;`).Error)
+}
+
+func (blobStore) put(tx *gorm.DB, sample_id int64,
+	values []SampleValue) error {
+	data, err := encodeVector(values)
+	if err != nil {
+		return err
+	}
+	err = tx.Where("sample_id = ?", sample_id).Delete(SampleVector{}).Error
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	return Err.Wrap(tx.Create(&SampleVector{
+		SampleId:       sample_id,
+		DimensionCount: len(values),
+		Data:           data}).Error)
+}
+
+func (blobStore) get(db *gorm.DB, sample_id int64) ([]SampleValue, error) {
+	var vec SampleVector
+	err := db.Where("sample_id = ?", sample_id).First(&vec).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	return decodeVector(sample_id, vec.Data)
+}
+
+func (s blobStore) page(db *gorm.DB, sample_id int64, pager *Pager) (
+	[]SampleValue, error) {
+	values, err := s.get(db, sample_id)
+	if err != nil {
+		return nil, err
+	}
+	if pager.Filter != "" {
+		var dim_ids []int64
+		err = db.Table("dimensions").Joins(
+			"JOIN samples ON samples.project_id = dimensions.project_id").Where(
+			"samples.id = ?", sample_id).Where(
+			`LOWER(dimensions.name) LIKE ? ESCAPE '\'`,
+			likePattern(pager.Filter)).Pluck("dimensions.id", &dim_ids).Error
+		if err != nil {
+			return nil, Err.Wrap(err)
+		}
+		matching := make(map[int64]bool, len(dim_ids))
+		for _, id := range dim_ids {
+			matching[id] = true
+		}
+		filtered := values[:0]
+		for _, val := range values {
+			if matching[val.DimensionId] {
+				filtered = append(filtered, val)
+			}
+		}
+		values = filtered
+	}
+
+	sort.Sort(valueSorter{values: values, key: sampleValueKey(pager.Sort),
+		desc: pager.Desc})
+
+	pager.Total = len(values)
+	if pager.Offset >= len(values) {
+		return nil, nil
+	}
+	values = values[pager.Offset:]
+	if len(values) > pager.Limit {
+		values = values[:pager.Limit]
+	}
+	return values, nil
+}
+
+func (s blobStore) topK(db *gorm.DB, sample_id int64, k int,
+	top_k_type TopKType) ([]SampleValue, error) {
+	values, err := s.get(db, sample_id)
+	if err != nil {
+		return nil, err
+	}
+	key := sampleValueKey("abs_rank_diff")
+	if top_k_type == TopKValueDiff {
+		key = sampleValueKey("abs_value_diff")
+	}
+	sort.Sort(valueSorter{values: values, key: key, desc: true})
+	if len(values) > k {
+		values = values[:k]
+	}
+	return values, nil
+}
+
+func (blobStore) each(db *gorm.DB, project_id int64,
+	cb func(sample_id int64, values []SampleValue) error) error {
+	rows, err := db.Table("sample_vectors").Select(
+		"sample_vectors.sample_id, sample_vectors.data").Joins(
+		"JOIN samples ON samples.id = sample_vectors.sample_id").Where(
+		"samples.project_id = ?", project_id).Rows()
+	if err != nil {
+		return Err.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sample_id int64
+		var data []byte
+		err = rows.Scan(&sample_id, &data)
+		if err != nil {
+			return Err.Wrap(err)
+		}
+		values, err := decodeVector(sample_id, data)
+		if err != nil {
+			return err
+		}
+		err = cb(sample_id, values)
+		if err != nil {
+			return err
+		}
+	}
+	return Err.Wrap(rows.Err())
+}
+
+// valueSorter orders values by key, if set, and then by dimension id.
+type valueSorter struct {
+	values []SampleValue
+	key    func(val SampleValue) float64
+	desc   bool
+}
+
+func (s valueSorter) Len() int { return len(s.values) }
+func (s valueSorter) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+func (s valueSorter) Less(i, j int) bool {
+	if s.key != nil {
+		a, b := s.key(s.values[i]), s.key(s.values[j])
+		if a != b {
+			return s.desc && a > b || !s.desc && a < b
+		}
+	}
+	return s.values[i].DimensionId < s.values[j].DimensionId
+}
+
+// sampleValueKey returns the sampleValueSorts column sort as a float.
+func sampleValueKey(sort string) func(val SampleValue) float64 {
+	switch sort {
+	case "rank":
+		return func(val SampleValue) float64 { return float64(val.Rank) }
+	case "abs_rank_diff":
+		return func(val SampleValue) float64 { return float64(val.AbsRankDiff) }
+	case "raw_value":
+		return func(val SampleValue) float64 { return val.RawValue }
+	case "value":
+		return func(val SampleValue) float64 { return val.Value }
+	case "value_diff":
+		return func(val SampleValue) float64 { return val.ValueDiff }
+	case "abs_value_diff":
+		return func(val SampleValue) float64 { return val.AbsValueDiff }
+	}
+	return func(val SampleValue) float64 { return float64(val.RankDiff) }
+}
+
+// storedPrecision rounds val's floats to float32s, the precision of the
+// sample_values real columns, so both stores return the same values. SQLite's
+// real is a float64, so the rows store rounds them itself.
+func storedPrecision(val SampleValue) SampleValue {
+	round := func(v float64) float64 { return float64(float32(v)) }
+	val.RawValue = round(val.RawValue)
+	val.Value = round(val.Value)
+	val.ValueDiff = round(val.ValueDiff)
+	val.AbsValueDiff = round(val.AbsValueDiff)
+	return val
+}
+
+// encodeVector packs values, sorted by dimension id, into a zlib compressed
+// blob. After a format byte and the value count, each field is stored as a
+// column: delta-encoded dimension ids, ranks and rank differences as
+// varints, then the raw values, values and value differences as float32s,
+// like the rows store keeps them. The absolute differences are derived when
+// decoding.
+func encodeVector(values []SampleValue) ([]byte, error) {
+	sorted := append([]SampleValue(nil), values...)
+	sort.Sort(valueSorter{values: sorted})
+
+	var buf bytes.Buffer
+	buf.WriteByte(vectorFormat)
+	z := zlib.NewWriter(&buf)
+	var scratch [binary.MaxVarintLen64]byte
+	varint := func(v int64) {
+		_, _ = z.Write(scratch[:binary.PutVarint(scratch[:], v)])
+	}
+	float := func(v float64) {
+		binary.LittleEndian.PutUint32(scratch[:4], math.Float32bits(float32(v)))
+		_, _ = z.Write(scratch[:4])
+	}
+
+	varint(int64(len(sorted)))
+	last := int64(0)
+	for _, val := range sorted {
+		varint(val.DimensionId - last)
+		last = val.DimensionId
+	}
+	for _, val := range sorted {
+		varint(int64(val.Rank))
+	}
+	for _, val := range sorted {
+		varint(int64(val.RankDiff))
+	}
+	for _, val := range sorted {
+		float(val.RawValue)
+	}
+	for _, val := range sorted {
+		float(val.Value)
+	}
+	for _, val := range sorted {
+		float(val.ValueDiff)
+	}
+	err := z.Close()
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeVector(sample_id int64, data []byte) ([]SampleValue, error) {
+	if len(data) == 0 || data[0] != vectorFormat {
+		return nil, Err.New("unknown sample vector format")
+	}
+	z, err := zlib.NewReader(bytes.NewReader(data[1:]))
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	raw, err := ioutil.ReadAll(z)
+	if err != nil {
+		return nil, Err.Wrap(err)
+	}
+	r := bytes.NewReader(raw)
+	varint := func() int64 {
+		v, e := binary.ReadVarint(r)
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	}
+	float := func() float64 {
+		var scratch [4]byte
+		_, e := io.ReadFull(r, scratch[:])
+		if e != nil && err == nil {
+			err = e
+		}
+		return float64(math.Float32frombits(
+			binary.LittleEndian.Uint32(scratch[:])))
+	}
+
+	count := varint()
+	if err != nil || count < 0 || count > int64(len(raw)) {
+		return nil, Err.New("corrupt sample vector")
+	}
+	values := make([]SampleValue, count)
+	last := int64(0)
+	for i := range values {
+		last += varint()
+		values[i].SampleId = sample_id
+		values[i].DimensionId = last
+	}
+	for i := range values {
+		values[i].Rank = int(varint())
+	}
+	for i := range values {
+		values[i].RankDiff = int(varint())
+		values[i].AbsRankDiff = values[i].RankDiff
+		if values[i].AbsRankDiff < 0 {
+			values[i].AbsRankDiff *= -1
+		}
+	}
+	for i := range values {
+		values[i].RawValue = float()
+	}
+	for i := range values {
+		values[i].Value = float()
+	}
+	for i := range values {
+		values[i].ValueDiff = float()
+		values[i].AbsValueDiff = math.Abs(values[i].ValueDiff)
+	}
+	if err != nil || r.Len() != 0 {
+		return nil, Err.New("corrupt sample vector")
+	}
+	return values, nil
+}
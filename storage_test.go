@@ -0,0 +1,271 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spacemonkeygo/errors"
+)
+
+func testValues(sample_id int64, n int) []SampleValue {
+	values := make([]SampleValue, 0, n)
+	for i := 1; i <= n; i++ {
+		sign := 1
+		if i%2 == 0 {
+			sign = -1
+		}
+		val := SampleValue{
+			SampleId:    sample_id,
+			DimensionId: int64(i * 3),
+			// ranks and absolute differences repeat, so sorting by them falls
+			// back to dimension ids. the floats aren't exact float32s.
+			Rank:      i / 2,
+			RankDiff:  sign * (i / 2),
+			RawValue:  float64(i) * 10.1,
+			Value:     float64(i%4) * 0.1,
+			ValueDiff: float64(sign*(i/2)) * 0.3}
+		val.AbsRankDiff = i / 2
+		val.AbsValueDiff = math.Abs(val.ValueDiff)
+		values = append(values, val)
+	}
+	return values
+}
+
+func TestVectorRoundTrip(t *testing.T) {
+	values := testValues(7, 50)
+	values[3].RawValue = math.NaN()
+	values[4].Value = math.NaN()
+	values[4].ValueDiff = math.NaN()
+	values[4].AbsValueDiff = math.NaN()
+	values[5].RankDiff, values[5].AbsRankDiff = -1<<40, 1<<40
+
+	// encodeVector sorts by dimension id itself.
+	shuffled := append([]SampleValue(nil), values...)
+	shuffled[0], shuffled[len(shuffled)-1] = shuffled[len(shuffled)-1],
+		shuffled[0]
+
+	data, err := encodeVector(shuffled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeVector(7, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(values) {
+		t.Fatalf("decoded %d values, expected %d", len(decoded), len(values))
+	}
+	for i := range values {
+		expected := storedPrecision(values[i])
+		if !sameValue(decoded[i], expected) {
+			t.Fatalf("value %d: got %+v, expected %+v", i, decoded[i],
+				expected)
+		}
+	}
+
+	empty, err := encodeVector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = decodeVector(7, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 0 {
+		t.Fatalf("decoded %d values from an empty vector", len(decoded))
+	}
+}
+
+// sameValue compares values, treating NaNs as equal.
+func sameValue(a, b SampleValue) bool {
+	floats := func(v SampleValue) []float64 {
+		return []float64{v.RawValue, v.Value, v.ValueDiff, v.AbsValueDiff}
+	}
+	fa, fb := floats(a), floats(b)
+	for i := range fa {
+		if !(fa[i] == fb[i] || math.IsNaN(fa[i]) && math.IsNaN(fb[i])) {
+			return false
+		}
+	}
+	a.RawValue, a.Value, a.ValueDiff, a.AbsValueDiff = 0, 0, 0, 0
+	b.RawValue, b.Value, b.ValueDiff, b.AbsValueDiff = 0, 0, 0, 0
+	return a == b
+}
+
+func TestVectorCorrupt(t *testing.T) {
+	data, err := encodeVector(testValues(1, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compress := func(payload []byte) []byte {
+		var buf bytes.Buffer
+		buf.WriteByte(vectorFormat)
+		z := zlib.NewWriter(&buf)
+		z.Write(payload)
+		z.Close()
+		return buf.Bytes()
+	}
+	var z bytes.Buffer
+	r, err := zlib.NewReader(bytes.NewReader(data[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = z.ReadFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := z.Bytes()
+
+	bad_format := append([]byte(nil), data...)
+	bad_format[0] = vectorFormat + 1
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+
+	for name, blob := range map[string][]byte{
+		"empty":             nil,
+		"unknown format":    bad_format,
+		"truncated blob":    data[:len(data)/2],
+		"corrupt blob":      flipped,
+		"truncated payload": compress(payload[:len(payload)-3]),
+		"trailing payload":  compress(append(payload, 0)),
+		"huge count":        compress([]byte{0xfe, 0xff, 0xff, 0xff, 0x0f}),
+		"negative count":    compress([]byte{0x01}),
+	} {
+		_, err := decodeVector(1, blob)
+		if err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
+
+func openStoreTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a separate database.
+	db.DB().SetMaxOpenConns(1)
+	var errs errors.ErrorGroup
+	errs.Add(db.CreateTable(&Sample{}, &Dimension{}).Error)
+	rowStore{}.createTables(db, &errs)
+	blobStore{}.createTables(db, &errs)
+	err = errs.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBlobStoreMatchesRowStore(t *testing.T) {
+	db := openStoreTestDB(t)
+	defer db.Close()
+
+	sample := Sample{ProjectId: 1, ControlId: 1, Name: "sample"}
+	err := db.Create(&sample).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := testValues(sample.Id, 40)
+	for _, val := range values {
+		name := fmt.Sprintf("dim-%d", val.DimensionId)
+		if val.DimensionId%2 == 0 {
+			name = fmt.Sprintf("even-%d", val.DimensionId)
+		}
+		err = db.Create(&Dimension{Id: val.DimensionId, ProjectId: 1,
+			Name: name}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stores := []sampleStore{rowStore{}, blobStore{}}
+	for _, store := range stores {
+		err = store.put(db, sample.Id, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, store := range stores {
+		stored, err := store.get(db, sample.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != len(values) {
+			t.Fatalf("%s: got %d values, expected %d", store.mode(),
+				len(stored), len(values))
+		}
+		for i := range values {
+			expected := storedPrecision(values[i])
+			if stored[i] != expected {
+				t.Fatalf("%s: value %d: got %+v, expected %+v", store.mode(), i,
+					stored[i], expected)
+			}
+		}
+	}
+
+	for _, sort := range sampleValueSorts {
+		for _, desc := range []bool{false, true} {
+			for _, filter := range []string{"", "even"} {
+				for _, offset := range []int{0, 7, 35} {
+					var pages [][]SampleValue
+					var totals []int
+					for _, store := range stores {
+						pager := &Pager{Offset: offset, Limit: 10, Sort: sort,
+							Desc: desc, Filter: filter}
+						page, err := store.page(db, sample.Id, pager)
+						if err != nil {
+							t.Fatal(err)
+						}
+						pages = append(pages, page)
+						totals = append(totals, pager.Total)
+					}
+					if totals[0] != totals[1] {
+						t.Errorf("sort %s desc %v filter %q: totals %v", sort,
+							desc, filter, totals)
+					}
+					if len(pages[0]) == 0 && len(pages[1]) == 0 {
+						continue
+					}
+					if !reflect.DeepEqual(pages[0], pages[1]) {
+						t.Errorf("sort %s desc %v filter %q offset %d:\n"+
+							"rows  %+v\nblobs %+v", sort, desc, filter, offset,
+							pages[0], pages[1])
+					}
+				}
+			}
+		}
+	}
+
+	// the absolute differences come in pairs, so a k of 4 splits a tie, which
+	// the lower dimension id wins.
+	for _, top_k_type := range []TopKType{TopKRankDiff, TopKValueDiff} {
+		for k, last := range map[int]int64{4: 108, 5: 111} {
+			var tops [][]SampleValue
+			for _, store := range stores {
+				top, err := store.topK(db, sample.Id, k, top_k_type)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tops = append(tops, top)
+			}
+			if len(tops[0]) != k || !reflect.DeepEqual(tops[0], tops[1]) {
+				t.Errorf("top %d %s:\nrows  %+v\nblobs %+v", k, top_k_type,
+					tops[0], tops[1])
+			}
+			if tops[0][k-1].DimensionId != last {
+				t.Errorf("top %d %s: ties weren't broken by dimension id: %+v",
+					k, top_k_type, tops[0])
+			}
+		}
+	}
+}
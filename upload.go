@@ -0,0 +1,300 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/spacemonkeygo/errors/errhttp"
+	"golang.org/x/net/context"
+	"gopkg.in/webhelp.v1/wherr"
+	"gopkg.in/webhelp.v1/whroute"
+)
+
+const (
+	valuesField  = "values"
+	maxFieldSize = 64 << 10
+)
+
+var (
+	maxUploadSize = flag.Int64("max_upload_size", 256<<20,
+		"the largest request body, in bytes, the server will accept")
+
+	ErrTooLarge = Err.NewClass("request too large", errhttp.SetStatusCode(413))
+)
+
+// limitBody refuses to read more than max_upload_size bytes of any request
+// body.
+func limitBody(h http.Handler) http.Handler {
+	return whroute.HandlerFunc(h,
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.ContentLength > *maxUploadSize {
+				http.Error(w, tooLarge().Error(),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			req.Body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, req.Body, *maxUploadSize)}
+			h.ServeHTTP(w, req)
+		})
+}
+
+// limitedBody remembers whether a request body went past its limit, since
+// parsers reading it may report the truncation as some other error.
+type limitedBody struct {
+	io.ReadCloser
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= *maxUploadSize {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+func tooLarge() error {
+	return ErrTooLarge.New("request body exceeds the %d byte limit",
+		*maxUploadSize)
+}
+
+// bodyError turns errors from reading req's body past its limit into
+// ErrTooLarge, and other read errors into bad requests.
+func bodyError(req *http.Request, err error) error {
+	if body, ok := req.Body.(*limitedBody); ok && body.exceeded {
+		return tooLarge()
+	}
+	if err.Error() == "http: POST too large" {
+		return tooLarge()
+	}
+	return wherr.BadRequest.Wrap(err)
+}
+
+// Upload is a form carrying dimension values. Fields holds the form values
+// sent before the values themselves, and Values streams the values, so that
+// large uploads are never held in memory.
+type Upload struct {
+	Fields url.Values
+	Values io.Reader
+
+	req *http.Request
+}
+
+type UploadHandler func(w http.ResponseWriter, req *http.Request,
+	user *UserInfo, upload *Upload)
+
+// readUpload checks the request's CSRF token and opens its values. Multipart
+// requests are streamed, so their other fields, including csrf_token, must
+// come before the values part. The first non-empty values part is used,
+// whether it is a file or a text field, and reading it fails if any other
+// field, or another non-empty values part, follows it.
+func readUpload(ctx context.Context, req *http.Request, user *UserInfo) (
+	*Upload, error) {
+	media_type, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if media_type != "multipart/form-data" {
+		err := checkCSRF(ctx, req, user)
+		if err != nil {
+			return nil, err
+		}
+		form, err := parseForm(req)
+		if err != nil {
+			return nil, err
+		}
+		return &Upload{
+			Fields: form,
+			Values: strings.NewReader(form.Get(valuesField)),
+			req:    req}, nil
+	}
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, bodyError(req, err)
+	}
+	upload := &Upload{
+		Fields: url.Values{},
+		Values: strings.NewReader(""),
+		req:    req}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, bodyError(req, err)
+		}
+		if part.FormName() == valuesField {
+			values := bufio.NewReader(part)
+			_, err = values.Peek(1)
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				return nil, bodyError(req, err)
+			}
+			upload.Values = &valuesPart{Reader: values, parts: reader, req: req}
+			break
+		}
+		val, err := readField(req, part)
+		if err != nil {
+			return nil, err
+		}
+		upload.Fields.Add(part.FormName(), val)
+	}
+
+	if !csrfExempt(req, user) {
+		token := req.Header.Get(csrfHeader)
+		if token == "" {
+			token = upload.Fields.Get(csrfField)
+		}
+		err = verifyCSRF(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// valuesPart streams a multipart upload's values part. Once it is read, it
+// checks that only empty values parts follow, as later fields would
+// otherwise be silently ignored.
+type valuesPart struct {
+	*bufio.Reader
+	parts *multipart.Reader
+	req   *http.Request
+	err   error
+}
+
+func (v *valuesPart) Read(p []byte) (n int, err error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err = v.Reader.Read(p)
+	if err == io.EOF {
+		v.err = v.checkRest()
+		if v.err != nil {
+			return n, v.err
+		}
+		v.err = io.EOF
+	}
+	return n, err
+}
+
+func (v *valuesPart) checkRest() error {
+	for {
+		part, err := v.parts.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return bodyError(v.req, err)
+		}
+		if part.FormName() != valuesField {
+			return wherr.BadRequest.New("form field %#v must come before %#v",
+				part.FormName(), valuesField)
+		}
+		n, err := io.ReadFull(part, make([]byte, 1))
+		if n > 0 {
+			return wherr.BadRequest.New("more than one %#v field is filled in",
+				valuesField)
+		}
+		if err != nil && err != io.EOF {
+			return bodyError(v.req, err)
+		}
+	}
+}
+
+// uploadError returns the error reading the upload's values ended with, if
+// the values were checked for later fields and failed.
+func (u *Upload) uploadError() error {
+	if values, ok := u.Values.(*valuesPart); ok && values.err != io.EOF {
+		return values.err
+	}
+	return nil
+}
+
+func readField(req *http.Request, part *multipart.Part) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize+1))
+	if err != nil {
+		return "", bodyError(req, err)
+	}
+	if len(data) > maxFieldSize {
+		return "", wherr.BadRequest.New("form field %#v is too long",
+			part.FormName())
+	}
+	return string(data), nil
+}
+
+// ParseValues reads "<dimension> <value>" lines from the upload's values,
+// delivering each as it is read.
+func (u *Upload) ParseValues(dimlookup *DimLookup,
+	deliver func(dim_id int64, value float64) error) error {
+	return u.ParseReplicates(dimlookup,
+		func(dim_id int64, replicates []float64) error {
+			if len(replicates) != 1 {
+				return wherr.BadRequest.New("expected one value per dimension")
+			}
+			return deliver(dim_id, replicates[0])
+		})
+}
+
+// ParseReplicates reads "<dimension> <value> [<value>...]" lines from the
+// upload's values, with one column per replicate, delivering each as it is
+// read. Every line must have the same number of values. replicates is reused
+// between calls to deliver.
+func (u *Upload) ParseReplicates(dimlookup *DimLookup,
+	deliver func(dim_id int64, replicates []float64) error) error {
+	scanner := bufio.NewScanner(u.Values)
+	var replicates []float64
+	columns := 0
+	for scanner.Scan() {
+		row := scanner.Text()
+		fields := strings.Fields(row)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || columns != 0 && len(fields) != columns {
+			return wherr.BadRequest.New("malformed data: %#v", row)
+		}
+		columns = len(fields)
+		id, err := dimlookup.LookupId(fields[0])
+		if err != nil {
+			return err
+		}
+		replicates = replicates[:0]
+		for _, field := range fields[1:] {
+			val, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return wherr.BadRequest.New("malformed data: %#v", row)
+			}
+			replicates = append(replicates, val)
+		}
+		err = deliver(id, replicates)
+		if err != nil {
+			return err
+		}
+	}
+	err := scanner.Err()
+	if err == bufio.ErrTooLong {
+		return wherr.BadRequest.New("malformed data: line too long")
+	}
+	if err != nil {
+		if upload_err := u.uploadError(); upload_err != nil {
+			return upload_err
+		}
+		return bodyError(u.req, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2016 JT Olds
+// See LICENSE for copying information
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/webhelp.v1/whcompat"
+	"gopkg.in/webhelp.v1/whfatal"
+	"gopkg.in/webhelp.v1/whsess"
+)
+
+// uploadServer wraps logic the way serve wraps the upload endpoints.
+func uploadServer(a *Endpoints, store whsess.Store,
+	logic UploadHandler) http.Handler {
+	return limitBody(whfatal.Catch(whsess.HandlerWithStore(store,
+		a.LoginOptional(Renderer{}.ProcessUpload(logic)))))
+}
+
+// multipartUpload encodes fields, in order, followed by a values file part.
+func multipartUpload(t *testing.T, fields [][2]string, values string) (
+	body *bytes.Buffer, content_type string) {
+	body = &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, field := range fields {
+		err := mw.WriteField(field[0], field[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := mw.CreateFormFile(valuesField, "values.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = part.Write([]byte(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, mw.FormDataContentType()
+}
+
+type receivedUpload struct {
+	user   *UserInfo
+	name   string
+	values string
+}
+
+func (r *receivedUpload) handle(w http.ResponseWriter, req *http.Request,
+	user *UserInfo, upload *Upload) {
+	values, err := ioutil.ReadAll(upload.Values)
+	if err != nil {
+		whfatal.Error(err)
+	}
+	r.user, r.name, r.values = user, upload.Fields.Get("name"), string(values)
+}
+
+const testUploadValues = "dim-a\t1.5\ndim-b\t-2\n"
+
+func TestMultipartUploadWithSession(t *testing.T) {
+	loadOAuth2()
+	store := whsess.NewCookieStore(make([]byte, 32))
+
+	// a page view gives the browser its session cookie and csrf token.
+	var token string
+	page := whsess.HandlerWithStore(store, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var err error
+			token, err = csrfToken(whcompat.Context(req), w)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}))
+	rec := httptest.NewRecorder()
+	page.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if token == "" || len(cookies) == 0 {
+		t.Fatalf("no csrf token or session cookie: %q %v", token, cookies)
+	}
+
+	var got receivedUpload
+	server := uploadServer(&Endpoints{}, store, got.handle)
+	body, content_type := multipartUpload(t,
+		[][2]string{{csrfField, token}, {"name", "sample"}}, testUploadValues)
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", content_type)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	if got.name != "sample" || got.values != testUploadValues {
+		t.Fatalf("got name %q and values %q", got.name, got.values)
+	}
+}
+
+func TestMultipartUploadWithQueryAPIKey(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.DB().SetMaxOpenConns(1)
+	err = db.CreateTable(&APIKey{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Create(&APIKey{UserId: "user", Name: "test",
+		Hash: hashAPIKey("secret"), Prefix: "secret",
+		CreatedAt: time.Now()}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got receivedUpload
+	server := uploadServer(&Endpoints{Data: &Data{db: db}},
+		whsess.NewCookieStore(make([]byte, 32)), got.handle)
+	body, content_type := multipartUpload(t, [][2]string{{"name", "sample"}},
+		testUploadValues)
+	req := httptest.NewRequest("POST", "/?api_key=secret", body)
+	req.Header.Set("Content-Type", content_type)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	if got.user == nil || got.user.Id != "user" {
+		t.Fatalf("upload wasn't authenticated with the key: %+v", got.user)
+	}
+	if got.name != "sample" || got.values != testUploadValues {
+		t.Fatalf("got name %q and values %q", got.name, got.values)
+	}
+}